@@ -13,3 +13,13 @@ var v = 10
 func Add(x, y int) int {
 	return x + y
 }
+
+// Div panics if y is 0.
+func Div(x, y int) int {
+	return x / y
+}
+
+// Threshold panics. It is a broken version of Threshold of plugin3.
+func Threshold() int {
+	panic("no threshold")
+}
@@ -13,3 +13,11 @@ var v = 10
 func Add(x, y int) int {
 	return (x + y) * 10
 }
+
+// Div returns -1 instead of panicking if y is 0.
+func Div(x, y int) int {
+	if y == 0 {
+		return -1
+	}
+	return x / y
+}
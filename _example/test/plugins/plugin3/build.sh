@@ -0,0 +1 @@
+go build -ldflags "-pluginpath=plugin/hot-$(uuidgen)" -buildmode=plugin -o plugin3.so main.go
\ No newline at end of file
@@ -0,0 +1,118 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/smallnest/glean/log"
+)
+
+var threshold = 1
+
+// Configure receives params of items.
+func Configure(params json.RawMessage) error {
+	if len(params) == 0 {
+		return nil
+	}
+
+	var p struct {
+		Threshold int  `json:"threshold"`
+		Panic     bool `json:"panic"`
+		Sleep     int  `json:"sleep"`
+	}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return err
+	}
+	if p.Panic {
+		panic("configure panics")
+	}
+	time.Sleep(time.Duration(p.Sleep) * time.Millisecond)
+	if p.Threshold < 0 {
+		return errors.New("threshold must not be negative")
+	}
+
+	threshold = p.Threshold
+	return nil
+}
+
+// Threshold returns the configured threshold.
+func Threshold() int {
+	return threshold
+}
+
+var calls []string
+
+// GleanInit is called when the plugin is opened.
+func GleanInit(ctx context.Context) error {
+	calls = append(calls, "init")
+	if threshold > 100 {
+		return errors.New("threshold is too large")
+	}
+	return nil
+}
+
+// host is the part of glean.Host used by this plugin.
+type host interface {
+	Logger() log.Logger
+	Lookup(id string) (interface{}, error)
+}
+
+var hostV int
+
+// GleanStart is called after GleanInit.
+func GleanStart(ctx context.Context, h host) error {
+	calls = append(calls, "start")
+	h.Logger().Info("plugin3 is started")
+
+	if v, err := h.Lookup("2E8FD057-99EC-41B9-8172-0EBF18F9A48D"); err == nil {
+		hostV = *(v.(*int))
+	}
+	return nil
+}
+
+// HostV returns V looked up from the host when the plugin is started.
+func HostV() int {
+	return hostV
+}
+
+// GleanStop is called when the plugin is not used any more.
+func GleanStop(ctx context.Context) error {
+	calls = append(calls, "stop")
+	return nil
+}
+
+// Calls returns lifecycle functions that have been called and resets them.
+func Calls() []string {
+	c := calls
+	calls = nil
+	return c
+}
+
+type symbol struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+}
+
+// GleanManifest describes this plugin.
+var GleanManifest = struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	Symbols []symbol `json:"symbols"`
+}{
+	Name:    "plugin3",
+	Version: "3.1.0",
+	Symbols: []symbol{
+		{ID: "plugin3.threshold", Name: "Threshold", Description: "returns the configured threshold", Type: "func() int"},
+		{ID: "plugin3.calls", Name: "Calls", Description: "returns called lifecycle functions", Type: "func() []string"},
+	},
+}
@@ -0,0 +1,174 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"encoding/json"
+	"net/http"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/smallnest/glean/log"
+)
+
+// AdminOption configures the handler returned by AdminHandler.
+type AdminOption func(*adminHandler)
+
+// AdminAuth sets a hook that authorizes every request of the admin handler.
+// A request is refused with 403 Forbidden if auth returns an error.
+func AdminAuth(auth func(r *http.Request) error) AdminOption {
+	return func(h *adminHandler) {
+		h.auth = auth
+	}
+}
+
+type adminHandler struct {
+	g    *Glean
+	auth func(r *http.Request) error
+	mux  *http.ServeMux
+}
+
+// AdminHandler returns an http.Handler that exposes Glean as JSON:
+//
+//	GET  /items                       status of all items, see Status
+//	GET  /history[?id=ID]             history of one or all items, see History
+//	GET  /config                      the resolved config, see DumpConfig
+//	POST /reload[?id=ID]              reload one item or the whole config
+//	POST /rollback?id=ID[&version=V]  roll back an item to a version in its history, or to the previous version
+//	POST /enable?id=ID                enable an item
+//	POST /disable?id=ID               disable an item
+//	POST /promote?id=ID               make the canary of an item its current version
+//	POST /abort?id=ID                 remove the canary of an item
+//
+// POST actions respond the status of all items, or an error with 404 Not Found for an unknown item or version,
+// 409 Conflict for an action that doesn't fit the current state of the item, such as no canary to promote,
+// or 500 Internal Server Error if applying the change failed.
+//
+// Mount it with http.StripPrefix, such as
+//
+//	http.Handle("/debug/glean/", http.StripPrefix("/debug/glean", glean.AdminHandler(g)))
+func AdminHandler(g *Glean, opts ...AdminOption) http.Handler {
+	h := &adminHandler{g: g, mux: http.NewServeMux()}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	h.mux.HandleFunc("/items", h.get(func(r *http.Request) interface{} {
+		return g.Status()
+	}))
+	h.mux.HandleFunc("/history", h.get(func(r *http.Request) interface{} {
+		return g.History(r.FormValue("id"))
+	}))
+	h.mux.HandleFunc("/config", h.get(func(r *http.Request) interface{} {
+		return g.DumpConfig()
+	}))
+	h.mux.HandleFunc("/reload", h.post(false, func(id string, r *http.Request) error {
+		if id == "" {
+			_, err := g.Refresh(r.Context())
+			return err
+		}
+		return g.ReloadItem(id)
+	}))
+	h.mux.HandleFunc("/rollback", h.post(true, func(id string, r *http.Request) error {
+		return g.Rollback(id, r.FormValue("version"))
+	}))
+	h.mux.HandleFunc("/enable", h.post(true, func(id string, r *http.Request) error {
+		return g.SetItemEnabled(id, true)
+	}))
+	h.mux.HandleFunc("/disable", h.post(true, func(id string, r *http.Request) error {
+		return g.SetItemEnabled(id, false)
+	}))
+	h.mux.HandleFunc("/promote", h.post(true, func(id string, r *http.Request) error {
+		return g.PromoteCanary(id)
+	}))
+	h.mux.HandleFunc("/abort", h.post(true, func(id string, r *http.Request) error {
+		return g.AbortCanary(id)
+	}))
+
+	return h
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.auth != nil {
+		if err := h.auth(r); err != nil {
+			writeJSON(w, http.StatusForbidden, adminError{Error: err.Error()})
+			return
+		}
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func (h *adminHandler) get(fn func(r *http.Request) interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+			return
+		}
+		writeJSON(w, http.StatusOK, fn(r))
+	}
+}
+
+// post handles an action and responds the status of all items after it.
+// The id parameter is required if needID is set.
+func (h *adminHandler) post(needID bool, fn func(id string, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+			return
+		}
+		id := r.FormValue("id")
+		if needID && id == "" {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: "id is required"})
+			return
+		}
+
+		err := fn(id, r)
+		if err != nil {
+			code := errorStatus(err)
+			if code == http.StatusInternalServerError {
+				log.Errorf("admin %s %s: %v", r.URL.Path, id, err)
+			}
+			writeJSON(w, code, adminError{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, h.g.Status())
+	}
+}
+
+// errorStatus returns the status code that responds err of an action.
+func errorStatus(err error) int {
+	if merr, ok := err.(*multierror.Error); ok && len(merr.Errors) == 1 {
+		err = merr.Errors[0]
+	}
+	switch e := err.(type) {
+	case *HistoryError:
+		if e.Version == "" {
+			return http.StatusConflict
+		}
+		return http.StatusNotFound
+	case *VersionError, *QuarantineError:
+		return http.StatusConflict
+	}
+	switch err {
+	case ErrItemHasNotConfigured:
+		return http.StatusNotFound
+	case ErrNoCanary:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Errorf("failed to write response: %v", err)
+	}
+}
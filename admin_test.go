@@ -0,0 +1,147 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/smallnest/glean/log"
+)
+
+func TestAdminHandler(t *testing.T) {
+	log.SetDummyLogger()
+
+	file := copyConfig(t, "plugin_test.json")
+	defer os.RemoveAll(filepath.Dir(file))
+
+	g := New(file)
+	defer g.Close()
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	id := "EF5A35EC-46EB-4E62-8251-78F1A49FA7DC"
+	var fn func(x, y int) int
+	if err := g.ReloadAndWatch(id, &fn); err != nil {
+		t.Fatalf("failed to reload fn: %v", err)
+	}
+	err := g.UpdateItem(PluginItem{ID: id, File: "_example/test/plugins/plugin1/plugin1.so", Name: "Add", Version: "1.1"})
+	if err != nil {
+		t.Fatalf("failed to update item: %v", err)
+	}
+
+	h := AdminHandler(g, AdminAuth(func(r *http.Request) error {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			return errors.New("invalid token")
+		}
+		return nil
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		code   int
+		fn     int
+	}{
+		{name: "unauthorized", method: "GET", target: "/items", code: http.StatusForbidden, fn: 3},
+		{name: "items", method: "GET", target: "/items", token: "secret", code: http.StatusOK, fn: 3},
+		{name: "history", method: "GET", target: "/history?id=" + id, token: "secret", code: http.StatusOK, fn: 3},
+		{name: "config", method: "GET", target: "/config", token: "secret", code: http.StatusOK, fn: 3},
+		{name: "method", method: "GET", target: "/reload", token: "secret", code: http.StatusMethodNotAllowed, fn: 3},
+		{name: "no id", method: "POST", target: "/rollback", token: "secret", code: http.StatusBadRequest, fn: 3},
+		{name: "unknown id", method: "POST", target: "/disable?id=abc", token: "secret", code: http.StatusNotFound, fn: 3},
+		{name: "unknown version", method: "POST", target: "/rollback?id=" + id + "&version=0.1", token: "secret", code: http.StatusNotFound, fn: 3},
+		{name: "no previous version", method: "POST", target: "/rollback?id=2E8FD057-99EC-41B9-8172-0EBF18F9A48D", token: "secret", code: http.StatusConflict, fn: 3},
+		{name: "no canary", method: "POST", target: "/promote?id=" + id, token: "secret", code: http.StatusConflict, fn: 3},
+		{name: "rollback", method: "POST", target: "/rollback?id=" + id + "&version=1.0", token: "secret", code: http.StatusOK, fn: 30},
+		{name: "rollback previous", method: "POST", target: "/rollback?id=" + id, token: "secret", code: http.StatusOK, fn: 3},
+		{name: "disable", method: "POST", target: "/disable?id=" + id, token: "secret", code: http.StatusOK, fn: 0},
+		{name: "enable", method: "POST", target: "/enable?id=" + id, token: "secret", code: http.StatusOK, fn: 3},
+		{name: "reload item", method: "POST", target: "/reload?id=" + id, token: "secret", code: http.StatusOK, fn: 3},
+		{name: "reload config", method: "POST", target: "/reload", token: "secret", code: http.StatusOK, fn: 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			if w.Header().Get("Content-Type") != "application/json" || !json.Valid(w.Body.Bytes()) {
+				t.Errorf("expect a json response but got %s", w.Body)
+			}
+			if got := fn(1, 2); got != tt.fn {
+				t.Errorf("fn(1, 2) = %d, want %d", got, tt.fn)
+			}
+		})
+	}
+
+	if item, ok := g.Snapshot().Item(id); !ok || item.Version != "1.0" {
+		t.Errorf("expect the config to be reloaded but got %+v", item)
+	}
+
+	var history []HistoryEntry
+	for _, e := range g.History(id) {
+		if e.Type == EventChanged {
+			history = append(history, e)
+		}
+	}
+	if len(history) < 3 || history[0].Item.Version != "1.1" || history[1].Item.Version != "1.0" {
+		t.Errorf("unexpected history: %+v", history)
+	}
+}
+
+func TestAdminHandler_ReloadFailed(t *testing.T) {
+	log.SetDummyLogger()
+
+	dir, err := ioutil.TempDir("", "glean")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	so := filepath.Join(dir, "plugin1.so")
+
+	g := New("plugin_test.json")
+	defer g.Close()
+	if err = g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if err = g.AddItem(PluginItem{ID: "broken", File: so, Name: "Add"}); err == nil {
+		t.Fatal("expect an error for the missing plugin")
+	}
+
+	// the plugin is fixed, so the failed item can be reloaded.
+	buf, err := ioutil.ReadFile("_example/test/plugins/plugin1/plugin1.so")
+	if err != nil {
+		t.Fatalf("failed to read plugin1: %v", err)
+	}
+	if err = ioutil.WriteFile(so, buf, 0755); err != nil {
+		t.Fatalf("failed to write %s: %v", so, err)
+	}
+
+	w := httptest.NewRecorder()
+	AdminHandler(g).ServeHTTP(w, httptest.NewRequest("POST", "/reload?id=broken", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if _, ok := g.Snapshot().Item("broken"); !ok {
+		t.Errorf("expect the failed item to be reloaded")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"fmt"
+	"reflect"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// BindOption configures how a function or variable is bound to an item by Reload, Watch and ReloadAndWatch.
+type BindOption func(*binding) error
+
+// binding is the options of a function or variable bound to an item.
+type binding struct {
+	constraint    *versionConstraint
+	instrument    bool
+	pprofLabels   bool
+	recover       bool
+	fallback      bool
+	rollbackAfter int
+	breaker       *BreakerConfig
+	canaryKey     func(args []interface{}) string
+	shadowCompare func(current, shadow []interface{}) bool
+	// v is the function or variable that is watched. It is bound again when a disabled item is enabled.
+	v interface{}
+	// cur and prev are the current and the previous versions that are bound.
+	cur  *boundSymbol
+	prev *boundSymbol
+}
+
+func newBinding(opts []BindOption) (*binding, error) {
+	b := &binding{}
+	var err error
+	for _, opt := range opts {
+		if e := opt(b); e != nil {
+			err = multierror.Append(err, e)
+		}
+	}
+	return b, err
+}
+
+// Requires refuses versions of the item that don't satisfy the semantic version constraint, such as ">=1.2, <2".
+// The version comes from the config or the manifest of the plugin.
+func Requires(constraint string) BindOption {
+	return func(b *binding) error {
+		c, err := parseConstraint(constraint)
+		if err != nil {
+			return err
+		}
+		b.constraint = c
+		return nil
+	}
+}
+
+// VersionError is returned when the version of an item doesn't satisfy the constraint of the bound function or variable.
+type VersionError struct {
+	ID         string
+	Version    string
+	Constraint string
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("version %q of %s does not satisfy %q", e.Version, e.ID, e.Constraint)
+}
+
+// unbindLocked replaces the function watched on the item by one that returns ErrItemDisabled,
+// so it doesn't call into the plugin that is stopped. The watch is kept. g.mu must be held.
+func (g *Glean) unbindLocked(id string) {
+	b := g.bindings[id]
+	if b == nil || !g.watched[id] || b.v == nil {
+		return
+	}
+	b.cur, b.prev = nil, nil
+
+	v := reflect.ValueOf(b.v).Elem()
+	if v.Kind() != reflect.Func {
+		return
+	}
+	t := v.Type()
+	errIndex := -1
+	if n := t.NumOut(); n > 0 && t.Out(n-1) == errorType {
+		errIndex = n - 1
+	}
+	v.Set(reflect.MakeFunc(t, func([]reflect.Value) []reflect.Value {
+		return zeroResults(t, errIndex, ErrItemDisabled)
+	}))
+}
+
+// checkVersion checks the version of item satisfies the constraint of b.
+func (b *binding) checkVersion(item *PluginItem) error {
+	if b == nil || b.constraint == nil || b.constraint.allows(item.Version) {
+		return nil
+	}
+	return &VersionError{ID: item.ID, Version: item.Version, Constraint: b.constraint.String()}
+}
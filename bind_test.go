@@ -0,0 +1,62 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"testing"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/smallnest/glean/log"
+)
+
+func TestGlean_ReloadRequires(t *testing.T) {
+	log.SetDummyLogger()
+
+	g := New("plugin_test.json")
+	defer g.Close()
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	id := "EF5A35EC-46EB-4E62-8251-78F1A49FA7DC"
+	var fn func(x, y int) int
+
+	if err := g.ReloadAndWatch(id, &fn, Requires(">=x")); err == nil {
+		t.Errorf("expect an error for an invalid constraint")
+	}
+	if err, ok := g.ReloadAndWatch(id, &fn, Requires(">=1.2, <2")).(*VersionError); !ok || err.Version != "1.0" {
+		t.Errorf("expect a VersionError but got %v", err)
+	}
+	if err := g.ReloadAndWatch(id, &fn, Requires(">=1.0, <2")); err != nil {
+		t.Fatalf("failed to reload fn: %v", err)
+	}
+
+	err := g.UpdateItem(PluginItem{ID: id, File: "_example/test/plugins/plugin1/plugin1.so", Name: "Add", Version: "2.0"})
+	if merr, ok := err.(*multierror.Error); !ok || len(merr.Errors) != 1 {
+		t.Errorf("expect a VersionError but got %v", err)
+	} else if _, ok = merr.Errors[0].(*VersionError); !ok {
+		t.Errorf("expect a VersionError but got %v", err)
+	}
+	if got := fn(1, 2); got != 30 {
+		t.Errorf("incompatible version must not be swapped in, got %d", got)
+	}
+
+	for _, st := range g.Status() {
+		if st.ID != id {
+			continue
+		}
+		if st.Version != "1.0" || st.Constraint != ">=1.0, <2" || st.Error == "" {
+			t.Errorf("unexpected status %+v", st)
+		}
+	}
+
+	err = g.UpdateItem(PluginItem{ID: id, File: "_example/test/plugins/plugin1/plugin1.so", Name: "Add", Version: "1.5"})
+	if err != nil {
+		t.Fatalf("failed to update item: %v", err)
+	}
+	if got := fn(1, 2); got != 3 {
+		t.Errorf("compatible version must be swapped in, got %d", got)
+	}
+}
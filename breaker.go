@@ -0,0 +1,165 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/smallnest/glean/log"
+	"github.com/smallnest/glean/metrics"
+)
+
+// BreakerConfig configures CircuitBreaker.
+type BreakerConfig struct {
+	// Threshold is the ratio of failed calls that trips the breaker, such as 0.5.
+	Threshold float64
+	// Window is how long calls are counted before the counts start over. The default is 1 minute.
+	Window time.Duration
+	// MinCalls is the least number of calls in a window to trip the breaker. The default is 10.
+	MinCalls int
+}
+
+// CircuitBreaker watches the failure rate of every version bound to the function. A call fails if it panics
+// or returns a non-nil error as its last result. If the rate of a version reaches the threshold within a window,
+// the item is rolled back to its previous version, EventRolledBack is sent and the version is quarantined.
+// If the version is the canary of the item, the canary is aborted instead.
+// Variables are not watched.
+func CircuitBreaker(c BreakerConfig) BindOption {
+	return func(b *binding) error {
+		if c.Threshold <= 0 || c.Threshold > 1 {
+			return fmt.Errorf("invalid breaker threshold %v", c.Threshold)
+		}
+		if c.Window <= 0 {
+			c.Window = time.Minute
+		}
+		if c.MinCalls <= 0 {
+			c.MinCalls = 10
+		}
+		b.breaker = &c
+		return nil
+	}
+}
+
+// QuarantineError is returned for a version of an item that has been quarantined because it misbehaved.
+// The version is not loaded again until the item is changed in the config or Unquarantine is called.
+type QuarantineError struct {
+	ID      string
+	Version string
+	Hash    string
+}
+
+func (e *QuarantineError) Error() string {
+	return fmt.Sprintf("version %q of %s is quarantined", e.Version, e.ID)
+}
+
+// breakerFunc wraps fn to count its calls and failures and to revert item if the failure rate is too high.
+func (g *Glean) breakerFunc(c *BreakerConfig, item *PluginItem, fn reflect.Value) reflect.Value {
+	t := fn.Type()
+	hasErr := t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType
+
+	var mu sync.Mutex
+	var start time.Time
+	var calls, failures int
+	var tripped int32
+	record := func(failed bool) {
+		if atomic.LoadInt32(&tripped) == 1 {
+			return
+		}
+
+		mu.Lock()
+		now := time.Now()
+		if now.Sub(start) > c.Window {
+			start, calls, failures = now, 0, 0
+		}
+		calls++
+		if failed {
+			failures++
+		}
+		trip := calls >= c.MinCalls && float64(failures) >= c.Threshold*float64(calls)
+		n, total := failures, calls
+		mu.Unlock()
+
+		if trip && atomic.CompareAndSwapInt32(&tripped, 0, 1) {
+			metrics.Add("glean_breaker_trips_total", 1, "id", item.ID, "version", item.Version)
+			g.revert(item, fmt.Errorf("%d of %d calls failed in %v", n, total, c.Window))
+		}
+	}
+
+	return reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+		panicked := true
+		defer func() {
+			if panicked {
+				record(true)
+			}
+		}()
+		out := callFunc(fn, in)
+		panicked = false
+		record(hasErr && !out[len(out)-1].IsNil())
+		return out
+	})
+}
+
+// revert quarantines the version of item and rolls the item back to its previous version in the background,
+// unless the item has been changed since then. If item is the canary of the item, the canary is aborted.
+func (g *Glean) revert(item *PluginItem, reason error) {
+	go func() {
+		g.mu.Lock()
+		cur := g.idMap[item.ID]
+		var canary bool
+		if cur != nil && cur.Canary != nil {
+			ci := cur.canaryItem()
+			canary = ci.Hash == item.Hash && ci.Version == item.Version
+		}
+		if g.closed || cur == nil || !canary && (cur.Hash != item.Hash || cur.Version != item.Version) {
+			g.mu.Unlock()
+			return
+		}
+		g.quarantined[item.ID] = &QuarantineError{ID: item.ID, Version: item.Version, Hash: item.Hash}
+		g.mu.Unlock()
+
+		log.Errorf("roll back %s of version %q and quarantine it: %v", item.ID, item.Version, reason)
+		rollback := func() error { return g.Rollback(item.ID, "") }
+		if canary {
+			rollback = func() error { return g.AbortCanary(item.ID) }
+		}
+		if err := rollback(); err != nil {
+			log.Errorf("failed to roll back %s: %v", item.ID, err)
+			reason = fmt.Errorf("%v, and failed to roll back: %v", reason, err)
+		}
+		g.emit(Event{Type: EventRolledBack, ID: item.ID, Item: item, Err: reason})
+	}()
+}
+
+// checkQuarantineLocked returns a QuarantineError if the version of item is quarantined. g.mu must be held.
+func (g *Glean) checkQuarantineLocked(item *PluginItem) error {
+	if q := g.quarantined[item.ID]; q != nil && q.Hash == item.Hash && q.Version == item.Version {
+		return q
+	}
+	return nil
+}
+
+// releaseQuarantineLocked releases quarantined versions that are no longer configured, which is
+// the case unless applying the config failed on the quarantined version. It is called after the config is applied.
+// g.mu must be held.
+func (g *Glean) releaseQuarantineLocked() {
+	for id, q := range g.quarantined {
+		if f := g.failures[id]; f != nil && f.err == error(q) {
+			continue
+		}
+		log.Infof("%s is changed in the config, release the quarantined version %q", id, q.Version)
+		delete(g.quarantined, id)
+	}
+}
+
+// Unquarantine releases the quarantined version of the item, which is loaded by the next apply if it is configured.
+func (g *Glean) Unquarantine(id string) {
+	g.mu.Lock()
+	delete(g.quarantined, id)
+	g.mu.Unlock()
+}
@@ -0,0 +1,94 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"testing"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/smallnest/glean/log"
+)
+
+func TestGlean_CircuitBreaker(t *testing.T) {
+	log.SetDummyLogger()
+
+	if _, err := newBinding([]BindOption{CircuitBreaker(BreakerConfig{Threshold: 2})}); err == nil {
+		t.Errorf("expect an error for an invalid threshold")
+	}
+
+	g := newWrapTestGlean(t)
+	defer g.Close()
+
+	rolledBack := make(chan Event, 1)
+	g.OnEvent(func(e Event) {
+		if e.Type == EventRolledBack {
+			rolledBack <- e
+		}
+	})
+
+	// plugin2 Div returns -1 for 0 and plugin1 Div panics.
+	v10 := PluginItem{ID: "div", File: "_example/test/plugins/plugin2/plugin2.so", Name: "Div", Version: "1.0"}
+	v11 := PluginItem{ID: "div", File: "_example/test/plugins/plugin1/plugin1.so", Name: "Div", Version: "1.1"}
+	if err := g.UpdateItem(v10); err != nil {
+		t.Fatalf("failed to update div: %v", err)
+	}
+	var div func(x, y int) int
+	err := g.ReloadAndWatch("div", &div, Recover(), CircuitBreaker(BreakerConfig{Threshold: 0.5, MinCalls: 4}))
+	if err != nil {
+		t.Fatalf("failed to reload div: %v", err)
+	}
+	if err = g.UpdateItem(v11); err != nil {
+		t.Fatalf("failed to update div: %v", err)
+	}
+
+	div(6, 3)
+	div(1, 0)
+	div(1, 0)
+	select {
+	case e := <-rolledBack:
+		t.Fatalf("unexpected rollback before enough calls: %v", e.Err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	div(1, 0)
+
+	select {
+	case e := <-rolledBack:
+		if e.ID != "div" || e.Item.Version != "1.1" || e.Err == nil {
+			t.Errorf("unexpected event: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect div to be rolled back")
+	}
+	if item, _ := g.Snapshot().Item("div"); item.Version != "1.0" {
+		t.Fatalf("expect div to be rolled back to 1.0 but got %s", item.Version)
+	}
+	if got := div(1, 0); got != -1 {
+		t.Errorf("expect div(1, 0) of 1.0 to return -1 but got %d", got)
+	}
+
+	// the quarantined version is refused until it is released.
+	err = g.UpdateItem(v11)
+	merr, ok := err.(*multierror.Error)
+	if !ok || len(merr.Errors) != 1 {
+		t.Fatalf("expect a quarantine error but got %v", err)
+	}
+	if qerr, ok := merr.Errors[0].(*QuarantineError); !ok || qerr.Version != "1.1" {
+		t.Errorf("expect a quarantine error but got %v", merr.Errors[0])
+	}
+	for _, st := range g.Status() {
+		if st.ID == "div" && (st.Version != "1.0" || st.Quarantined != "1.1") {
+			t.Errorf("unexpected status: %+v", st)
+		}
+	}
+
+	g.Unquarantine("div")
+	if err = g.UpdateItem(v11); err != nil {
+		t.Fatalf("failed to update div: %v", err)
+	}
+	if item, _ := g.Snapshot().Item("div"); item.Version != "1.1" {
+		t.Errorf("expect div 1.1 to be loaded but got %s", item.Version)
+	}
+}
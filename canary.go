@@ -0,0 +1,198 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"plugin"
+	"reflect"
+
+	"github.com/smallnest/glean/log"
+	"github.com/smallnest/glean/metrics"
+)
+
+// CanaryConfig routes a percentage of calls of the function bound to an item to another version of the plugin.
+// Both versions stay loaded until the canary is promoted by PromoteCanary or aborted by AbortCanary.
+// In shadow mode the canary doesn't serve calls but runs in the shadow of the current version.
+// Variables are not routed.
+type CanaryConfig struct {
+	// File is the plugin file of the canary version.
+	File string `json:"file"`
+	// Version is the version of the canary. It becomes the version of the item when the canary is promoted.
+	Version string `json:"version,omitempty"`
+	// Percent is the percentage of calls that are routed to the canary, or run in its shadow, from 0 to 100.
+	Percent float64 `json:"percent"`
+	// Shadow makes the percentage of calls run on both versions. The results of the current version are returned,
+	// and the results of the canary are compared with them by ShadowCompare before the call returns.
+	// A mismatch is counted as glean_shadow_mismatches_total{id, version} and sent as EventShadowMismatch.
+	Shadow bool `json:"shadow,omitempty"`
+	// Hash is the sha256 of the canary plugin file when it is opened.
+	Hash string `json:"-"`
+	// Cached points the opened canary plugin.
+	Cached *plugin.Plugin `json:"-"`
+}
+
+// CanaryKey makes calls of the bound function sticky: calls whose arguments have the same key
+// are always routed to the same version. key is called with the arguments of every call.
+// In shadow mode the key makes the same calls run in the shadow every time.
+// Without it calls are routed randomly.
+func CanaryKey(key func(args []interface{}) string) BindOption {
+	return func(b *binding) error {
+		b.canaryKey = key
+		return nil
+	}
+}
+
+// canaryItem returns the canary of item as an item with the same ID and name.
+func (item *PluginItem) canaryItem() *PluginItem {
+	c := item.Canary
+	version := c.Version
+	if version == "" {
+		version = item.Version
+	}
+	return &PluginItem{
+		ID:      item.ID,
+		Name:    item.Name,
+		File:    c.File,
+		Version: version,
+		Params:  item.Params,
+		Type:    item.Type,
+		Plugin:  item.Plugin,
+		Hash:    c.Hash,
+		Cached:  c.Cached,
+	}
+}
+
+// canaryChanged reports whether the canaries of two versions of an item differ.
+func canaryChanged(old, latest *CanaryConfig) bool {
+	if old == nil || latest == nil {
+		return old != latest
+	}
+	return old.File != latest.File || old.Version != latest.Version || old.Percent != latest.Percent ||
+		old.Shadow != latest.Shadow || old.Hash != "" && latest.Hash != "" && old.Hash != latest.Hash
+}
+
+func validateCanary(item *PluginItem) error {
+	c := item.Canary
+	if c.File == "" {
+		return fmt.Errorf("canary of item %s must have file", item.ID)
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("canary percent of item %s must be in [0, 100] but is %v", item.ID, c.Percent)
+	}
+	return nil
+}
+
+// prepareCanaryLocked opens and configures the canary of the prepared item and starts its plugin. g.mu must be held.
+func (g *Glean) prepareCanaryLocked(p *preparedItem) error {
+	item, change := p.item, p.change
+	ci := item.canaryItem()
+	if err := g.checkQuarantineLocked(ci); err != nil {
+		log.Errorf("refuse to load the canary of %s: %v", item.ID, err)
+		return err
+	}
+
+	// the canary is not changed, so only look up the symbol again.
+	var pp *plugin.Plugin
+	reopen := change == nil || change.Has(FieldCanary) || change.Old.Canary == nil
+	if !reopen {
+		pp = change.Old.Canary.Cached
+	}
+
+	pp, _, err := lookupItem(ci, pp, item.v)
+	if err != nil {
+		return err
+	}
+	ci.Cached = pp
+
+	if reopen {
+		if err = g.configureItem(ci); err != nil {
+			return err
+		}
+	} else if change.Has(FieldParams) {
+		p.reconfigure = append(p.reconfigure, ci)
+	}
+	if err = g.startPluginLocked(ci); err != nil {
+		return err
+	}
+
+	c := *item.Canary
+	c.Cached = pp
+	item.Canary = &c
+	return nil
+}
+
+// canaryFunc returns a function that routes calls to cfn of the canary, or to fn of the item otherwise.
+// It returns fn if the canary can't be bound to the function.
+func (g *Glean) canaryFunc(b *binding, item *PluginItem, fn reflect.Value) reflect.Value {
+	ci := item.canaryItem()
+	s, err := ci.Cached.Lookup(ci.Name)
+	if err != nil || reflect.TypeOf(s) != fn.Type() {
+		log.Errorf("canary of %s can't be bound to %v: %v", item.ID, fn.Type(), err)
+		return fn
+	}
+	cfn := g.wrapFunc(b, ci, reflect.ValueOf(s))
+	if item.Canary.Shadow {
+		return g.shadowFunc(b, item, ci, fn, cfn)
+	}
+
+	percent := item.Canary.Percent
+	key := b.canaryKey
+	return reflect.MakeFunc(fn.Type(), func(in []reflect.Value) []reflect.Value {
+		target, v := fn, item
+		if routeToCanary(key, in, percent) {
+			target, v = cfn, ci
+		}
+		metrics.Add("glean_canary_calls_total", 1, "id", v.ID, "version", v.Version)
+		return callFunc(target, in)
+	})
+}
+
+// routeToCanary reports whether a call with in is routed to the canary.
+func routeToCanary(key func(args []interface{}) string, in []reflect.Value, percent float64) bool {
+	if key == nil {
+		return rand.Float64()*100 < percent
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key(interfaces(in))))
+	return float64(h.Sum32()%10000) < percent*100
+}
+
+// PromoteCanary makes the canary of the item its current version, so all calls go to it.
+func (g *Glean) PromoteCanary(id string) error {
+	return g.modifyCanary(id, func(it *PluginItem) {
+		if v := it.Canary.Version; v != "" {
+			it.Version = v
+		}
+		it.File = it.Canary.File
+		it.Canary = nil
+	})
+}
+
+// AbortCanary removes the canary of the item, so all calls go to its current version.
+func (g *Glean) AbortCanary(id string) error {
+	return g.modifyCanary(id, func(it *PluginItem) {
+		it.Canary = nil
+	})
+}
+
+func (g *Glean) modifyCanary(id string, fn func(*PluginItem)) error {
+	return g.modifyItems(func(items []*PluginItem) ([]*PluginItem, error) {
+		for _, it := range items {
+			if it.ID == id {
+				if it.Canary == nil {
+					return nil, ErrNoCanary
+				}
+				fn(it)
+				it.expandedFrom = nil
+				return items, nil
+			}
+		}
+		return nil, ErrItemHasNotConfigured
+	})
+}
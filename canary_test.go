@@ -0,0 +1,98 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/smallnest/glean/log"
+	"github.com/smallnest/glean/metrics"
+)
+
+func TestGlean_Canary(t *testing.T) {
+	log.SetDummyLogger()
+	m := metrics.NewExpvarMetrics("")
+	metrics.SetMetrics(m)
+	defer metrics.SetDummyMetrics()
+
+	g := New("plugin_test.json")
+	defer g.Close()
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	id := "EF5A35EC-46EB-4E62-8251-78F1A49FA7DC"
+	var add func(x, y int) int
+	// the first argument is the key, so a call goes to the same version every time.
+	key := CanaryKey(func(args []interface{}) string { return fmt.Sprint(args[0]) })
+	if err := g.ReloadAndWatch(id, &add, key); err != nil {
+		t.Fatalf("failed to reload add: %v", err)
+	}
+
+	// plugin2 Add returns (x + y) * 10 and plugin1 Add returns x + y.
+	item := PluginItem{ID: id, File: "_example/test/plugins/plugin2/plugin2.so", Name: "Add", Version: "1.0"}
+	canary := &CanaryConfig{File: "_example/test/plugins/plugin1/plugin1.so", Version: "1.1", Percent: 150}
+	item.Canary = canary
+	if err := g.UpdateItem(item); err == nil {
+		t.Errorf("expect an error for an invalid percent")
+	}
+
+	tests := []struct {
+		percent float64
+		canary  int
+	}{
+		{0, 0},
+		{100, 100},
+		{50, -1},
+	}
+	for _, tt := range tests {
+		c := *canary
+		c.Percent = tt.percent
+		item.Canary = &c
+		if err := g.UpdateItem(item); err != nil {
+			t.Fatalf("failed to update the canary to %v%%: %v", tt.percent, err)
+		}
+
+		n := 0
+		for i := 1; i <= 100; i++ {
+			got := add(i, 0)
+			if got != i*10 && got != i || add(i, 0) != got {
+				t.Fatalf("unexpected or unsticky add(%d, 0) = %d", i, got)
+			}
+			if got == i {
+				n++
+			}
+		}
+		if tt.canary >= 0 && n != tt.canary {
+			t.Errorf("expect %d calls routed to the canary at %v%% but got %d", tt.canary, tt.percent, n)
+		}
+		if tt.canary < 0 && (n == 0 || n == 100) {
+			t.Errorf("expect some calls routed to the canary at %v%% but got %d", tt.percent, n)
+		}
+	}
+
+	if m.Counter("glean_canary_calls_total", "id", id, "version", "1.1") == 0 {
+		t.Errorf("expect calls of the canary to be counted")
+	}
+	for _, st := range g.Status() {
+		if st.ID == id && (st.Canary == nil || st.Canary.Percent != 50) {
+			t.Errorf("unexpected status: %+v", st)
+		}
+	}
+
+	if err := g.PromoteCanary(id); err != nil {
+		t.Fatalf("failed to promote the canary: %v", err)
+	}
+	if got := add(1, 2); got != 3 {
+		t.Errorf("expect the promoted plugin1 Add to return 3 but got %d", got)
+	}
+	if cur, _ := g.Snapshot().Item(id); cur.Version != "1.1" || cur.Canary != nil {
+		t.Errorf("unexpected promoted item: %+v", cur)
+	}
+	if err := g.AbortCanary(id); err != ErrNoCanary {
+		t.Errorf("expect ErrNoCanary but got %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+)
+
+// Fields of PluginItem that are compared to detect changes.
+const (
+	FieldFile     = "file"
+	FieldName     = "name"
+	FieldVersion  = "version"
+	FieldHash     = "hash"
+	FieldParams   = "params"
+	FieldRequires = "requires"
+	FieldCanary   = "canary"
+	// FieldDependency means the item itself is not changed but an item it requires is changed or removed.
+	FieldDependency = "dependency"
+)
+
+// ItemChange describes an item that exists in both the current and the latest items but differs.
+type ItemChange struct {
+	Old *PluginItem
+	New *PluginItem
+	// Fields are the names of the changed fields, such as FieldFile and FieldHash.
+	Fields []string
+}
+
+// Has reports whether field is changed.
+func (c *ItemChange) Has(field string) bool {
+	for _, f := range c.Fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Reason explains why the item is changed.
+func (c *ItemChange) Reason() string {
+	return strings.Join(c.Fields, ",") + " changed"
+}
+
+// ChangeSet is the difference between two sets of items.
+type ChangeSet struct {
+	Added   []*PluginItem
+	Changed []*ItemChange
+	Removed []*PluginItem
+}
+
+// Empty reports whether nothing is changed.
+func (cs *ChangeSet) Empty() bool {
+	return len(cs.Added) == 0 && len(cs.Changed) == 0 && len(cs.Removed) == 0
+}
+
+func diffPlugins(currentPluginItems, latestPluginItems []*PluginItem) (cs ChangeSet) {
+	latestM := make(map[string]*PluginItem)
+	for _, item := range latestPluginItems {
+		latestM[item.ID] = item
+	}
+
+	currentM := make(map[string]*PluginItem)
+	for _, item := range currentPluginItems {
+		currentM[item.ID] = item
+	}
+
+	for _, item := range latestPluginItems {
+		if i, exist := currentM[item.ID]; exist {
+			if fields := diffItem(i, item); len(fields) > 0 {
+				cs.Changed = append(cs.Changed, &ItemChange{Old: i, New: item, Fields: fields})
+			}
+		} else {
+			cs.Added = append(cs.Added, item)
+		}
+	}
+
+	for _, item := range currentPluginItems {
+		if _, exist := latestM[item.ID]; !exist {
+			cs.Removed = append(cs.Removed, item)
+		}
+	}
+
+	return
+}
+
+// diffItem returns the names of fields that differ between the two items.
+// Hashes are only compared when both of them are known.
+func diffItem(old, latest *PluginItem) (fields []string) {
+	if old.File != latest.File {
+		fields = append(fields, FieldFile)
+	}
+	if old.Name != latest.Name {
+		fields = append(fields, FieldName)
+	}
+	if old.Version != latest.Version {
+		fields = append(fields, FieldVersion)
+	}
+	if old.Hash != "" && latest.Hash != "" && old.Hash != latest.Hash {
+		fields = append(fields, FieldHash)
+	}
+	if !jsonEqual(old.Params, latest.Params) {
+		fields = append(fields, FieldParams)
+	}
+	if strings.Join(old.Requires, "\n") != strings.Join(latest.Requires, "\n") {
+		fields = append(fields, FieldRequires)
+	}
+	if canaryChanged(old.Canary, latest.Canary) {
+		fields = append(fields, FieldCanary)
+	}
+	return fields
+}
+
+// jsonEqual reports whether a and b are the same JSON regardless of insignificant spaces.
+func jsonEqual(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+// hashItems computes content hashes of the plugin files of items.
+// Files that can't be read keep an empty hash and will fail when they are opened.
+func hashItems(items []*PluginItem) {
+	hashes := make(map[string]string)
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		h, ok := hashes[item.File]
+		if !ok {
+			h, _ = hashFile(item.File)
+			hashes[item.File] = h
+		}
+		item.Hash = h
+
+		if item.Canary != nil {
+			h, ok := hashes[item.Canary.File]
+			if !ok {
+				h, _ = hashFile(item.Canary.File)
+				hashes[item.Canary.File] = h
+			}
+			c := *item.Canary
+			c.Hash = h
+			item.Canary = &c
+		}
+	}
+}
+
+// hashFile returns the hex encoded sha256 of the file content.
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
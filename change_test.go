@@ -0,0 +1,87 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffPlugins(t *testing.T) {
+	current := []*PluginItem{
+		{ID: "a", File: "a.so", Name: "Add", Version: "1.0", Hash: "h1"},
+		{ID: "b", File: "b.so", Name: "V", Version: "1.0"},
+		{ID: "c", File: "c.so", Name: "V", Version: "1.0"},
+	}
+
+	tests := []struct {
+		name    string
+		latest  []*PluginItem
+		added   []string
+		changed map[string][]string
+		removed []string
+	}{
+		{
+			name: "unchanged",
+			latest: []*PluginItem{
+				{ID: "a", File: "a.so", Name: "Add", Version: "1.0", Hash: "h1"},
+				{ID: "b", File: "b.so", Name: "V", Version: "1.0"},
+				{ID: "c", File: "c.so", Name: "V", Version: "1.0"},
+			},
+		},
+		{
+			name: "fields",
+			latest: []*PluginItem{
+				{ID: "a", File: "a.so", Name: "AddV2", Version: "1.1", Hash: "h1"},
+				{ID: "b", File: "b2.so", Name: "V", Version: "1.0", Hash: "h2"},
+				{ID: "c", File: "c.so", Name: "V", Version: "1.0"},
+			},
+			changed: map[string][]string{
+				"a": {FieldName, FieldVersion},
+				"b": {FieldFile},
+			},
+		},
+		{
+			name: "rebuilt",
+			latest: []*PluginItem{
+				{ID: "a", File: "a.so", Name: "Add", Version: "1.0", Hash: "h2"},
+				{ID: "d", File: "d.so", Name: "V", Version: "1.0"},
+			},
+			added:   []string{"d"},
+			changed: map[string][]string{"a": {FieldHash}},
+			removed: []string{"b", "c"},
+		},
+	}
+
+	ids := func(items []*PluginItem) (ids []string) {
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+		return ids
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := diffPlugins(current, tt.latest)
+			if got := ids(cs.Added); !reflect.DeepEqual(got, tt.added) {
+				t.Errorf("added = %v, want %v", got, tt.added)
+			}
+			if got := ids(cs.Removed); !reflect.DeepEqual(got, tt.removed) {
+				t.Errorf("removed = %v, want %v", got, tt.removed)
+			}
+			if len(cs.Changed) != len(tt.changed) {
+				t.Fatalf("changed = %d items, want %d", len(cs.Changed), len(tt.changed))
+			}
+			for _, c := range cs.Changed {
+				if !reflect.DeepEqual(c.Fields, tt.changed[c.New.ID]) {
+					t.Errorf("changed fields of %s = %v, want %v", c.New.ID, c.Fields, tt.changed[c.New.ID])
+				}
+			}
+			if cs.Empty() != (tt.added == nil && tt.changed == nil && tt.removed == nil) {
+				t.Errorf("Empty() = %v", cs.Empty())
+			}
+		})
+	}
+}
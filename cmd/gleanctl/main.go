@@ -0,0 +1,228 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+// gleanctl controls a process that serves the control channel of glean by Glean.ListenControl.
+//
+// Usage:
+//
+//	gleanctl [-socket path] list
+//	gleanctl [-socket path] status [id]
+//	gleanctl [-socket path] history [id]
+//	gleanctl [-socket path] reload [id]
+//	gleanctl [-socket path] rollback <id> [version]
+//	gleanctl [-socket path] enable <id>
+//	gleanctl [-socket path] disable <id>
+//	gleanctl [-socket path] promote <id>
+//	gleanctl [-socket path] abort <id>
+//	gleanctl [-socket path] plan <file>
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+
+	"github.com/smallnest/glean"
+)
+
+var socket = flag.String("socket", envOr("GLEAN_SOCKET", "/tmp/glean.sock"), "unix domain socket of the control channel, $GLEAN_SOCKET")
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: gleanctl [-socket path] <command> [args]
+
+commands:
+  list                     list items
+  status [id]              show status of all items or one item
+  history [id]             show history of one or all items
+  reload [id]              reload one item or the whole config
+  rollback <id> [version]  roll back an item to a version, or to the previous version
+  enable <id>              enable an item
+  disable <id>             disable an item
+  promote <id>             make the canary of an item its current version
+  abort <id>               remove the canary of an item
+  plan <file>              show what the config file would change
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	req, err := request(args[0], args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		usage()
+		os.Exit(2)
+	}
+
+	c, err := glean.DialControl(*socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect to %s: %v\n", *socket, err)
+		os.Exit(1)
+	}
+	defer c.Close()
+
+	var result json.RawMessage
+	if err = c.Call(req, &result); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list":
+		err = printList(result)
+	case "plan":
+		err = printPlan(result)
+	default:
+		err = printJSON(result)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// request converts the command line to a request.
+func request(cmd string, args []string) (*glean.ControlRequest, error) {
+	req := &glean.ControlRequest{Cmd: cmd}
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+
+	var min, max int
+	switch cmd {
+	case "list":
+		req.Cmd = "status"
+	case "status", "history", "reload":
+		max = 1
+		req.ID = arg(0)
+	case "rollback":
+		min, max = 1, 2
+		req.ID, req.Version = arg(0), arg(1)
+	case "enable", "disable", "promote", "abort":
+		min, max = 1, 1
+		req.ID = arg(0)
+	case "plan":
+		min, max = 1, 1
+		if len(args) == 1 {
+			buf, err := ioutil.ReadFile(args[0])
+			if err != nil {
+				return nil, err
+			}
+			req.Config = string(buf)
+		}
+	default:
+		return nil, fmt.Errorf("unknown command %s", cmd)
+	}
+
+	if len(args) < min || len(args) > max {
+		return nil, fmt.Errorf("wrong number of arguments for %s", cmd)
+	}
+	return req, nil
+}
+
+func printJSON(result json.RawMessage) error {
+	var v interface{}
+	if err := json.Unmarshal(result, &v); err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(buf))
+	return nil
+}
+
+func printList(result json.RawMessage) error {
+	var status []glean.ItemStatus
+	if err := json.Unmarshal(result, &status); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tVERSION\tGENERATION\tSTATE")
+	for _, st := range status {
+		state := "active"
+		switch {
+		case st.Skipped != "":
+			state = "skipped: " + st.Skipped
+		case st.Error != "" && st.Active:
+			state = "active, failed: " + st.Error
+		case st.Error != "":
+			state = "failed: " + st.Error
+		}
+		if c := st.Canary; c != nil {
+			state += fmt.Sprintf(", canary %s at %v%%", c.Version, c.Percent)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", st.ID, st.Name, st.Version, st.Generation, state)
+	}
+	return w.Flush()
+}
+
+func printPlan(result json.RawMessage) error {
+	var plan struct {
+		OK      bool     `json:"ok"`
+		Added   []string `json:"added"`
+		Changed []struct {
+			ID     string   `json:"id"`
+			Fields []string `json:"fields"`
+		} `json:"changed"`
+		Removed  []string `json:"removed"`
+		Bindings []struct {
+			ID    string `json:"id"`
+			Want  string `json:"want"`
+			Got   string `json:"got"`
+			Error string `json:"error"`
+		} `json:"bindings"`
+		Errors []string `json:"errors"`
+	}
+	if err := json.Unmarshal(result, &plan); err != nil {
+		return err
+	}
+
+	for _, id := range plan.Added {
+		fmt.Printf("+ %s\n", id)
+	}
+	for _, c := range plan.Changed {
+		fmt.Printf("~ %s %v\n", c.ID, c.Fields)
+	}
+	for _, id := range plan.Removed {
+		fmt.Printf("- %s\n", id)
+	}
+	for _, b := range plan.Bindings {
+		if b.Error != "" {
+			fmt.Printf("! %s: %s\n", b.ID, b.Error)
+		}
+	}
+	for _, e := range plan.Errors {
+		fmt.Printf("! %s\n", e)
+	}
+	if !plan.OK {
+		return fmt.Errorf("the config can't be applied cleanly")
+	}
+	fmt.Println("ok")
+	return nil
+}
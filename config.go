@@ -0,0 +1,209 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/smallnest/glean/log"
+)
+
+// ProfileEnv is the environment variable that sets the profile if WithProfile is not used.
+const ProfileEnv = "GLEAN_PROFILE"
+
+// config is the object format of the config file. Besides an array of items, the config file can be
+//
+//	{
+//	    "items": [{"id": "handler", "file": "plugins/${REGION}/handler.so", "name": "Handle"}],
+//	    "profiles": {
+//	        "prod": [{"id": "handler", "params": {"debug": false}}, {"id": "audit", "file": "audit.so", "name": "Audit"}]
+//	    }
+//	}
+//
+// Items of the profile of this process are overlaid on items: fields of an item with the same id are replaced
+// and other items are appended.
+type config struct {
+	Items    []map[string]interface{}            `json:"items"`
+	Profiles map[string][]map[string]interface{} `json:"profiles"`
+}
+
+// parseConfig parses buf as an array of items or a config object, overlays the profile
+// and interpolates environment variables in all strings.
+func (g *Glean) parseConfig(buf []byte) ([]*PluginItem, error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber() // keep numbers in params as they are.
+
+	var raw []map[string]interface{}
+	if trimmed := bytes.TrimSpace(buf); len(trimmed) > 0 && trimmed[0] == '{' {
+		var c config
+		if err := dec.Decode(&c); err != nil {
+			return nil, err
+		}
+		raw = c.Items
+		if overlay, ok := c.Profiles[g.profile]; ok {
+			raw = overlayItems(raw, overlay)
+		} else if g.profile != "" && len(c.Profiles) > 0 {
+			log.Warnf("profile %s is not defined in the config", g.profile)
+		}
+	} else if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	var err error
+	for _, item := range raw {
+		for k, v := range item {
+			v, e := interpolate(v)
+			if e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s of item %v: %v", k, item["id"], e))
+			}
+			item[k] = v
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var items []*PluginItem
+	err = json.Unmarshal(resolved, &items)
+	return items, err
+}
+
+// usesTemplates reports whether the config in buf has profiles or ${VAR}.
+func usesTemplates(buf []byte) bool {
+	if trimmed := bytes.TrimSpace(buf); len(trimmed) > 0 && trimmed[0] == '{' {
+		var c config
+		if json.Unmarshal(trimmed, &c) == nil && len(c.Profiles) > 0 {
+			return true
+		}
+	}
+	return varPattern.Match(buf)
+}
+
+// overlayItems replaces fields of items by overlay items with the same id and appends the others.
+func overlayItems(items, overlay []map[string]interface{}) []map[string]interface{} {
+	for _, o := range overlay {
+		var base map[string]interface{}
+		for _, item := range items {
+			if item != nil && o != nil && item["id"] == o["id"] {
+				base = item
+				break
+			}
+		}
+		if base == nil {
+			items = append(items, o)
+			continue
+		}
+		for k, v := range o {
+			base[k] = v
+		}
+	}
+	return items
+}
+
+var varPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolate replaces ${VAR} and ${VAR:-default} in all strings of v by environment variables.
+// $$ is a literal $. A variable that is not set and has no default is an error.
+func interpolate(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		var missing []string
+		s := varPattern.ReplaceAllStringFunc(v, func(m string) string {
+			if m == "$$" {
+				return "$"
+			}
+			sub := varPattern.FindStringSubmatch(m)
+			if val, ok := os.LookupEnv(sub[1]); ok {
+				return val
+			}
+			if sub[2] != "" {
+				return sub[3]
+			}
+			missing = append(missing, sub[1])
+			return ""
+		})
+		if len(missing) > 0 {
+			return v, fmt.Errorf("environment variables %v are not set", missing)
+		}
+		return s, nil
+	case []interface{}:
+		var err error
+		for i := range v {
+			var e error
+			if v[i], e = interpolate(v[i]); e != nil {
+				err = e
+			}
+		}
+		return v, err
+	case map[string]interface{}:
+		var err error
+		for k := range v {
+			var e error
+			if v[k], e = interpolate(v[k]); e != nil {
+				err = e
+			}
+		}
+		return v, err
+	}
+	return v, nil
+}
+
+// ConfigDump is the config that Glean has resolved and loaded.
+type ConfigDump struct {
+	// Source is the config file, or the plugin directory if Glean is created by NewFromDir.
+	Source string `json:"source"`
+	// LastKnownGood is set if the items are loaded from the last known good config instead of Source.
+	LastKnownGood bool `json:"last_known_good,omitempty"`
+	// Profile is the profile of this process.
+	Profile string            `json:"profile,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	// Items are the active items after profiles, interpolation and manifests are resolved.
+	Items []*PluginItem `json:"items"`
+	// Failed are items that failed to load.
+	Failed []*PluginItem `json:"failed,omitempty"`
+	// Skipped are items that don't apply to this process.
+	Skipped []*PluginItem `json:"skipped,omitempty"`
+}
+
+// DumpConfig returns the resolved config for debugging, which is what has actually been loaded.
+func (g *Glean) DumpConfig() *ConfigDump {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	d := &ConfigDump{
+		Source:        g.configFile,
+		LastKnownGood: g.fallback,
+		Profile:       g.profile,
+		Labels:        g.labels,
+		Items:         append([]*PluginItem{}, g.pluginItems...),
+		Skipped:       append([]*PluginItem(nil), g.skipped...),
+	}
+	if g.dir != "" {
+		d.Source = g.dir
+	}
+
+	var failed []string
+	for id := range g.failures {
+		if _, ok := g.idMap[id]; !ok {
+			failed = append(failed, id)
+		}
+	}
+	sort.Strings(failed)
+	for _, id := range failed {
+		d.Failed = append(d.Failed, g.failures[id].item)
+	}
+
+	return d
+}
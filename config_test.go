@@ -0,0 +1,136 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/smallnest/glean/log"
+)
+
+func TestGlean_ParseConfig(t *testing.T) {
+	os.Setenv("GLEAN_TEST_REGION", "eu")
+	defer os.Unsetenv("GLEAN_TEST_REGION")
+
+	tests := []struct {
+		name    string
+		profile string
+		config  string
+		wantErr bool
+		want    []PluginItem
+	}{
+		{
+			name:   "array",
+			config: `[{"id":"a","file":"plugins/${GLEAN_TEST_REGION}/a.so","name":"A","params":{"n":12345678901234567890}}]`,
+			want:   []PluginItem{{ID: "a", File: "plugins/eu/a.so", Name: "A", Params: []byte(`{"n":12345678901234567890}`)}},
+		},
+		{
+			name:   "default",
+			config: `[{"id":"a","file":"${GLEAN_TEST_DIR:-plugins}/a.so","name":"A","params":{"s":"$${HOME}"}}]`,
+			want:   []PluginItem{{ID: "a", File: "plugins/a.so", Name: "A", Params: []byte(`{"s":"${HOME}"}`)}},
+		},
+		{
+			name:    "unset",
+			config:  `[{"id":"a","file":"${GLEAN_TEST_DIR}/a.so","name":"A"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "profile",
+			profile: "prod",
+			config: `{
+				"items": [{"id":"a","file":"a.so","name":"A","version":"1.0"},{"id":"b","file":"b.so","name":"B"}],
+				"profiles": {
+					"dev": [{"id":"c","file":"c.so","name":"C"}],
+					"prod": [{"id":"a","version":"${GLEAN_TEST_REGION}-2.0"},{"id":"d","file":"d.so","name":"D"}]
+				}
+			}`,
+			want: []PluginItem{
+				{ID: "a", File: "a.so", Name: "A", Version: "eu-2.0"},
+				{ID: "b", File: "b.so", Name: "B"},
+				{ID: "d", File: "d.so", Name: "D"},
+			},
+		},
+		{
+			name:   "no profile",
+			config: `{"items": [{"id":"a","file":"a.so","name":"A"}], "profiles": {"dev": [{"id":"c","file":"c.so","name":"C"}]}}`,
+			want:   []PluginItem{{ID: "a", File: "a.so", Name: "A"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := New("", WithProfile(tt.profile))
+			items, err := g.parseConfig([]byte(tt.config))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(items) != len(tt.want) {
+				t.Fatalf("got %d items, want %d", len(items), len(tt.want))
+			}
+			for i, item := range items {
+				w := tt.want[i]
+				if item.ID != w.ID || item.File != w.File || item.Name != w.Name || item.Version != w.Version || string(item.Params) != string(w.Params) {
+					t.Errorf("item #%d = %+v, want %+v", i, item, w)
+				}
+			}
+		})
+	}
+}
+
+func TestGlean_DumpConfig(t *testing.T) {
+	log.SetDummyLogger()
+
+	os.Setenv("GLEAN_TEST_PLUGIN", "plugin1")
+	defer os.Unsetenv("GLEAN_TEST_PLUGIN")
+
+	dir, err := ioutil.TempDir("", "glean")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	file := filepath.Join(dir, "plugin.json")
+	config := `{
+		"items": [
+			{"id":"add","file":"` + wd + `/_example/test/plugins/${GLEAN_TEST_PLUGIN}/${GLEAN_TEST_PLUGIN}.so","name":"Add","version":"1.0"},
+			{"id":"v","file":"` + wd + `/_example/test/plugins/plugin2/plugin2.so","name":"V","profiles":["dev"]}
+		],
+		"profiles": {
+			"staging": [{"id":"add","version":"1.1-rc"}]
+		}
+	}`
+	if err = ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	g := New(file, WithProfile("staging"))
+	defer g.Close()
+	if err = g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	var fn func(x, y int) int
+	if err = g.Reload("add", &fn); err != nil {
+		t.Fatalf("failed to reload fn: %v", err)
+	}
+	if got := fn(1, 2); got != 3 {
+		t.Errorf("expect plugin1 Add to return 3 but got %d", got)
+	}
+
+	d := g.DumpConfig()
+	if d.Source != file || d.Profile != "staging" {
+		t.Errorf("unexpected dump: %+v", d)
+	}
+	if len(d.Items) != 1 || d.Items[0].Version != "1.1-rc" || filepath.Base(d.Items[0].File) != "plugin1.so" {
+		t.Errorf("unexpected items: %+v", d.Items)
+	}
+	if len(d.Skipped) != 1 || d.Skipped[0].ID != "v" {
+		t.Errorf("unexpected skipped items: %+v", d.Skipped)
+	}
+}
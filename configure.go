@@ -0,0 +1,56 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/smallnest/glean/log"
+)
+
+// ConfigureSymbol is the name of an optional function exported by plugins to receive params of items.
+// It must be a func(json.RawMessage) error. It is called when an item is loaded and when its params change.
+// Notice it is called once for every item of the plugin.
+// A Configure that panics or doesn't return within the lifecycle timeout fails the item like an error does.
+// A plugin that is serving gets changed params only when the item is swapped in, and gets the old params back
+// if Configure fails or, in atomic mode, if another item fails.
+const ConfigureSymbol = "Configure"
+
+// configureItem delivers params of item to the Configure function exported by its plugin, if any.
+// Like lifecycle functions, Configure is called with the lifecycle timeout and its panic is returned as an error.
+func (g *Glean) configureItem(item *PluginItem) error {
+	s, err := item.Cached.Lookup(ConfigureSymbol)
+	if err != nil { // the plugin doesn't need params
+		return nil
+	}
+
+	fn, ok := symbolValue(s).Interface().(func(json.RawMessage) error)
+	if !ok {
+		return fmt.Errorf("%s in %s must be func(json.RawMessage) error", ConfigureSymbol, item.File)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("%s of %s panics: %v", ConfigureSymbol, item.File, r)
+			}
+		}()
+		done <- fn(item.Params)
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(g.timeout):
+		err = fmt.Errorf("%s of %s timed out after %v", ConfigureSymbol, item.File, g.timeout)
+	}
+	if err != nil {
+		log.Errorf("failed to configure %s with %s: %v", item.ID, item.Params, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smallnest/glean/log"
+)
+
+func TestGlean_Configure(t *testing.T) {
+	log.SetDummyLogger()
+
+	file := copyConfig(t, "plugin_test.json")
+	defer os.RemoveAll(filepath.Dir(file))
+
+	g := New(file)
+	defer g.Close()
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	var failed []Event
+	g.OnEvent(func(e Event) {
+		if e.Type == EventFailed {
+			failed = append(failed, e)
+		}
+	})
+
+	item := PluginItem{ID: "threshold", File: "_example/test/plugins/plugin3/plugin3.so", Name: "Threshold", Params: json.RawMessage(`{"threshold": 5}`)}
+	if err := g.AddItem(item); err != nil {
+		t.Fatalf("failed to add item: %v", err)
+	}
+
+	var threshold func() int
+	if err := g.ReloadAndWatch("threshold", &threshold); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if threshold() != 5 {
+		t.Errorf("expect threshold 5 but got %d", threshold())
+	}
+	cached := g.idMap["threshold"].Cached
+
+	item.Params = json.RawMessage(`{"threshold":7}`)
+	if err := g.UpdateItem(item); err != nil {
+		t.Fatalf("failed to update params: %v", err)
+	}
+	if threshold() != 7 {
+		t.Errorf("expect threshold 7 but got %d", threshold())
+	}
+	if g.idMap["threshold"].Cached != cached {
+		t.Errorf("params change must not reopen the plugin")
+	}
+
+	item.Params = json.RawMessage(`{"threshold":-1}`)
+	if err := g.UpdateItem(item); err == nil {
+		t.Errorf("expect an error for invalid params")
+	}
+	if threshold() != 7 || len(failed) != 1 {
+		t.Errorf("expect threshold 7 and a failed event but got %d and %v", threshold(), failed)
+	}
+
+	var found bool
+	for _, st := range g.Status() {
+		if st.ID == "threshold" {
+			found = true
+			if !st.Active || st.Error == "" {
+				t.Errorf("expect an active item with an error but got %+v", st)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("item threshold is not in status")
+	}
+}
+
+func TestGlean_ConfigureAtomic(t *testing.T) {
+	log.SetDummyLogger()
+
+	g := New("plugin_test.json", WithAtomicReload())
+	defer g.Close()
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	item := PluginItem{ID: "threshold", File: "_example/test/plugins/plugin3/plugin3.so", Name: "Threshold", Params: json.RawMessage(`{"threshold": 5}`)}
+	if err := g.AddItem(item); err != nil {
+		t.Fatalf("failed to add item: %v", err)
+	}
+	var threshold func() int
+	if err := g.ReloadAndWatch("threshold", &threshold); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+
+	// the pass is aborted by the broken item, so the serving plugin must not see the new params.
+	err := g.modifyItems(func(items []*PluginItem) ([]*PluginItem, error) {
+		for _, it := range items {
+			if it.ID == "threshold" {
+				it.Params = json.RawMessage(`{"threshold": 9}`)
+			}
+		}
+		return append(items, &PluginItem{ID: "broken", File: "_example/test/plugins/missing.so", Name: "Add"}), nil
+	})
+	if err == nil {
+		t.Fatal("expect the pass to fail")
+	}
+	if threshold() != 5 {
+		t.Errorf("expect threshold 5 after an aborted pass but got %d", threshold())
+	}
+}
+
+func TestGlean_ConfigureFailure(t *testing.T) {
+	log.SetDummyLogger()
+
+	tests := []struct {
+		name   string
+		params string
+	}{
+		{"panic", `{"threshold": 9, "panic": true}`},
+		{"timeout", `{"threshold": 9, "sleep": 500}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := New("plugin_test.json", WithLifecycleTimeout(100*time.Millisecond))
+			defer g.Close()
+			if err := g.LoadConfig(); err != nil {
+				t.Fatalf("failed to load config: %v", err)
+			}
+
+			var failed []Event
+			g.OnEvent(func(e Event) {
+				if e.Type == EventFailed {
+					failed = append(failed, e)
+				}
+			})
+
+			item := PluginItem{ID: "threshold", File: "_example/test/plugins/plugin3/plugin3.so", Name: "Threshold", Params: json.RawMessage(`{"threshold": 5}`)}
+			if err := g.AddItem(item); err != nil {
+				t.Fatalf("failed to add item: %v", err)
+			}
+			var threshold func() int
+			if err := g.ReloadAndWatch("threshold", &threshold); err != nil {
+				t.Fatalf("failed to reload: %v", err)
+			}
+
+			item.Params = json.RawMessage(tt.params)
+			if err := g.UpdateItem(item); err == nil {
+				t.Errorf("expect an error for the failed Configure")
+			}
+			if len(failed) != 1 {
+				t.Errorf("expect a failed event but got %v", failed)
+			}
+
+			// the lock must have been released.
+			var found bool
+			for _, st := range g.Status() {
+				if st.ID == "threshold" {
+					found = true
+					if !st.Active || st.Error == "" {
+						t.Errorf("expect an active item with an error but got %+v", st)
+					}
+				}
+			}
+			if !found {
+				t.Errorf("item threshold is not in status")
+			}
+		})
+	}
+}
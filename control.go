@@ -0,0 +1,257 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/smallnest/glean/log"
+)
+
+// maxControlLine is the max size of a request of the control channel, which may carry a whole config.
+const maxControlLine = 16 << 20
+
+// ControlRequest is a request of the control channel. It is sent as one line of JSON.
+type ControlRequest struct {
+	// Cmd is one of "status", "history", "reload", "rollback", "enable", "disable", "promote", "abort" and "plan".
+	Cmd     string `json:"cmd"`
+	ID      string `json:"id,omitempty"`
+	Version string `json:"version,omitempty"`
+	// Config is the content of the config to plan.
+	Config string `json:"config,omitempty"`
+}
+
+// ControlResponse is the response of a ControlRequest. It is sent as one line of JSON.
+type ControlResponse struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// ListenControl listens on the unix domain socket and serves the control channel until Glean is closed.
+// The socket is only accessible by the owner. A stale socket file is replaced, and the socket is removed
+// when Glean is closed.
+//
+// Every request is a line of ControlRequest and is answered by a line of ControlResponse:
+//
+//	status [id]         status of all items or one item, see Status
+//	history [id]        history of one or all items, see History
+//	reload [id]         reload one item or the whole config
+//	rollback id [ver]   roll back an item to a version in its history, or to the previous version
+//	enable id           enable an item
+//	disable id          disable an item
+//	promote id          make the canary of an item its current version
+//	abort id            remove the canary of an item
+//	plan config         what Glean would do with the config, see Plan
+//
+// Actions respond the status of all items after them.
+func (g *Glean) ListenControl(socket string) error {
+	if g.closed {
+		return ErrClosed
+	}
+
+	ln, err := listenUnix(socket)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Lstat(socket)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	g.wg.Add(2)
+	go func() {
+		defer g.wg.Done()
+		<-g.done
+		ln.Close()
+		// remove the socket unless it has been replaced by another one.
+		if cur, err := os.Lstat(socket); err == nil && os.SameFile(fi, cur) {
+			os.Remove(socket)
+		}
+	}()
+
+	go func() {
+		defer g.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				select {
+				case <-g.done:
+				default:
+					log.Errorf("control channel %s is closed: %v", socket, err)
+				}
+				return
+			}
+			go g.serveControl(conn)
+		}
+	}()
+
+	return nil
+}
+
+// listenUnix listens on the unix domain socket that is only accessible by the owner.
+// The socket is created in a private directory and then moved to its path, so it is never accessible by others.
+func listenUnix(socket string) (*net.UnixListener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(socket), ".glean")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Chmod(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	tmp := filepath.Join(dir, "control.sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket is moved, so it is removed by its new path when Glean is closed.
+	ln.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	if fi, err := os.Lstat(socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(socket)
+	}
+	if err = os.Rename(tmp, socket); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func (g *Glean) serveControl(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), maxControlLine)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var resp ControlResponse
+		var req ControlRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = err.Error()
+		} else if result, err := g.control(&req); err != nil {
+			resp.Error = err.Error()
+		} else if resp.Result, err = json.Marshal(result); err != nil {
+			resp.Error = err.Error()
+		}
+
+		if err := enc.Encode(&resp); err != nil {
+			log.Errorf("failed to write control response: %v", err)
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Errorf("failed to read control request: %v", err)
+	}
+}
+
+func (g *Glean) control(req *ControlRequest) (interface{}, error) {
+	var err error
+	switch req.Cmd {
+	case "status":
+		status := g.Status()
+		if req.ID == "" {
+			return status, nil
+		}
+		for _, st := range status {
+			if st.ID == req.ID {
+				return []ItemStatus{st}, nil
+			}
+		}
+		return nil, ErrItemHasNotConfigured
+	case "history":
+		return g.History(req.ID), nil
+	case "plan":
+		return g.Plan([]byte(req.Config))
+	case "reload":
+		if req.ID == "" {
+			_, err = g.Refresh(context.Background())
+		} else {
+			err = g.ReloadItem(req.ID)
+		}
+	case "rollback", "enable", "disable", "promote", "abort":
+		if req.ID == "" {
+			return nil, fmt.Errorf("%s needs an id", req.Cmd)
+		}
+		switch req.Cmd {
+		case "rollback":
+			err = g.Rollback(req.ID, req.Version)
+		case "promote":
+			err = g.PromoteCanary(req.ID)
+		case "abort":
+			err = g.AbortCanary(req.ID)
+		default:
+			err = g.SetItemEnabled(req.ID, req.Cmd == "enable")
+		}
+	default:
+		return nil, fmt.Errorf("unknown command %q", req.Cmd)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return g.Status(), nil
+}
+
+// ControlClient is a client of the control channel. See ListenControl.
+type ControlClient struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+// DialControl connects to the control channel on the unix domain socket.
+func DialControl(socket string) (*ControlClient, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), maxControlLine)
+	return &ControlClient{conn: conn, scanner: scanner}, nil
+}
+
+// Call sends req and decodes the result into result, which may be nil.
+// An error of the command is returned as an error.
+func (c *ControlClient) Call(req *ControlRequest, result interface{}) error {
+	if err := json.NewEncoder(c.conn).Encode(req); err != nil {
+		return err
+	}
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			return err
+		}
+		return errors.New("control channel is closed")
+	}
+
+	var resp ControlResponse
+	if err := json.Unmarshal(c.scanner.Bytes(), &resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if result == nil || len(resp.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// Close closes the connection.
+func (c *ControlClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,110 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smallnest/glean/log"
+)
+
+func TestGlean_ListenControl(t *testing.T) {
+	log.SetDummyLogger()
+
+	file := copyConfig(t, "plugin_test.json")
+	defer os.RemoveAll(filepath.Dir(file))
+	socket := filepath.Join(filepath.Dir(file), "glean.sock")
+
+	g := New(file)
+	defer g.Close()
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if err := g.ListenControl(socket); err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("unexpected socket: %v, %v", fi, err)
+	}
+
+	id := "EF5A35EC-46EB-4E62-8251-78F1A49FA7DC"
+	var fn func(x, y int) int
+	if err := g.ReloadAndWatch(id, &fn); err != nil {
+		t.Fatalf("failed to reload fn: %v", err)
+	}
+	err := g.UpdateItem(PluginItem{ID: id, File: "_example/test/plugins/plugin1/plugin1.so", Name: "Add", Version: "1.1"})
+	if err != nil {
+		t.Fatalf("failed to update item: %v", err)
+	}
+
+	c, err := DialControl(socket)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+
+	var status []ItemStatus
+	if err = c.Call(&ControlRequest{Cmd: "status", ID: id}, &status); err != nil {
+		t.Fatalf("failed to get status: %v", err)
+	}
+	if len(status) != 1 || status[0].Version != "1.1" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	if err = c.Call(&ControlRequest{Cmd: "rollback", ID: id, Version: "1.0"}, &status); err != nil {
+		t.Fatalf("failed to roll back: %v", err)
+	}
+	if got := fn(1, 2); got != 30 {
+		t.Errorf("expect plugin2 Add to return 30 but got %d", got)
+	}
+	if len(status) != 2 || status[0].Version != "1.0" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	if err = c.Call(&ControlRequest{Cmd: "rollback"}, nil); err == nil {
+		t.Errorf("expect an error for rollback without id")
+	}
+	if err = c.Call(&ControlRequest{Cmd: "foo"}, nil); err == nil {
+		t.Errorf("expect an error for an unknown command")
+	}
+
+	config, _ := ioutil.ReadFile("plugin_test.json")
+	var plan struct {
+		OK      bool `json:"ok"`
+		Changed []struct {
+			ID string `json:"id"`
+		} `json:"changed"`
+	}
+	if err = c.Call(&ControlRequest{Cmd: "plan", Config: string(config)}, &plan); err != nil {
+		t.Fatalf("failed to plan: %v", err)
+	}
+	if !plan.OK || len(plan.Changed) != 0 {
+		t.Errorf("unexpected plan: %+v", plan)
+	}
+	if err = c.Call(&ControlRequest{Cmd: "plan", Config: "[{"}, nil); err == nil {
+		t.Errorf("expect an error for an invalid config")
+	}
+
+	if err = c.Call(&ControlRequest{Cmd: "reload"}, &status); err != nil {
+		t.Fatalf("failed to reload config: %v", err)
+	}
+
+	// the socket is created in a private directory that is removed once the socket is in place.
+	if files, _ := ioutil.ReadDir(filepath.Dir(socket)); len(files) != 2 {
+		t.Errorf("expect only the config and the socket but got %d files", len(files))
+	}
+	g.Close()
+	for i := 0; i < 100; i++ {
+		if _, err = os.Lstat(socket); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expect the socket to be removed when Glean is closed: %v", err)
+}
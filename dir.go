@@ -0,0 +1,96 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/smallnest/glean/log"
+)
+
+// dirSettleDelay is how long the directory must be quiet before it is scanned again,
+// so a plugin that is being copied is not opened half written.
+const dirSettleDelay = 200 * time.Millisecond
+
+// NewFromDir returns a Glean that discovers plugins in dir instead of reading a config file.
+// Every *.so in dir is described by a sidecar JSON file with the same base name (foo.so and foo.json),
+// which has the format of Manifest, or else by the GleanManifest exported by the plugin.
+// Plugins without either are skipped. Call LoadConfig to load them and watch dir for new, removed
+// and replaced plugins. A plugin replaced in place must be built with a different -pluginpath.
+func NewFromDir(dir string, opts ...Option) *Glean {
+	g := New("", opts...)
+	g.dir = dir
+	return g
+}
+
+func isDirFile(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == ".so" || ext == ".json"
+}
+
+// scanDir derives items from plugins in dir.
+func scanDir(dir string) ([]*PluginItem, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.so"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var items []*PluginItem
+	for _, file := range files {
+		m, err := dirManifest(file)
+		if err != nil {
+			log.Errorf("skip %s: %v", file, err)
+			continue
+		}
+		if m == nil {
+			log.Warnf("skip %s: it has neither a sidecar json nor %s", file, ManifestSymbol)
+			continue
+		}
+
+		for _, e := range m.Symbols {
+			item := &PluginItem{
+				ID:          e.ID,
+				File:        file,
+				Name:        e.Name,
+				Version:     m.Version,
+				Description: e.Description,
+				Type:        e.Type,
+				Plugin:      m.Name,
+				Requires:    append(append([]string(nil), m.Requires...), e.Requires...),
+			}
+			items = append(items, item)
+		}
+	}
+
+	return items, nil
+}
+
+// dirManifest reads the sidecar json of the plugin file, or the manifest exported by the plugin.
+func dirManifest(file string) (*Manifest, error) {
+	buf, err := ioutil.ReadFile(strings.TrimSuffix(file, ".so") + ".json")
+	if err == nil {
+		var m Manifest
+		if err = json.Unmarshal(buf, &m); err != nil {
+			return nil, err
+		}
+		return &m, nil
+	}
+
+	hash, err := hashFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pp, err := openPlugin(file, hash)
+	if err != nil {
+		return nil, err
+	}
+	return ReadManifest(pp)
+}
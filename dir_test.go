@@ -0,0 +1,89 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/smallnest/glean/log"
+)
+
+func TestNewFromDir(t *testing.T) {
+	log.SetDummyLogger()
+
+	dir, err := ioutil.TempDir("", "glean")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// plugins are linked because the Go runtime refuses to open a copy of a loaded plugin.
+	link := func(so, name string) {
+		abs, err := filepath.Abs(so)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Symlink(abs, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("failed to link %s: %v", so, err)
+		}
+	}
+
+	link("_example/test/plugins/plugin3/plugin3.so", "plugin3.so")
+	link("_example/test/plugins/plugin2/plugin2.so", "nomanifest.so")
+
+	g := NewFromDir(dir)
+	defer g.Close()
+	if err = g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load dir: %v", err)
+	}
+
+	ids := func() []string {
+		return g.Snapshot().IDs()
+	}
+	waitIDs := func(want []string) {
+		deadline := time.Now().Add(3 * time.Second)
+		for time.Now().Before(deadline) && !reflect.DeepEqual(ids(), want) {
+			time.Sleep(20 * time.Millisecond)
+		}
+		if got := ids(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("expect items %v but got %v", want, got)
+		}
+	}
+
+	waitIDs([]string{"plugin3.calls", "plugin3.threshold"})
+
+	sidecar := `{"name":"p1","version":"1.0","requires":["plugin3.calls"],
+		"symbols":[{"id":"p1.add","name":"Add","type":"func(int, int) int","requires":["plugin3.threshold"]}]}`
+	if err = ioutil.WriteFile(filepath.Join(dir, "p1.json"), []byte(sidecar), 0644); err != nil {
+		t.Fatalf("failed to write sidecar: %v", err)
+	}
+	link("_example/test/plugins/plugin1/plugin1.so", "p1.so")
+	waitIDs([]string{"p1.add", "plugin3.calls", "plugin3.threshold"})
+
+	item, _ := g.Snapshot().Item("p1.add")
+	if item.Version != "1.0" || item.Plugin != "p1" || !reflect.DeepEqual(item.Requires, []string{"plugin3.calls", "plugin3.threshold"}) {
+		t.Errorf("unexpected item from sidecar: %+v", item)
+	}
+
+	if err = os.Remove(filepath.Join(dir, "p1.so")); err != nil {
+		t.Fatalf("failed to remove p1.so: %v", err)
+	}
+	waitIDs([]string{"plugin3.calls", "plugin3.threshold"})
+}
+
+func TestNewFromDir_Missing(t *testing.T) {
+	log.SetDummyLogger()
+
+	g := NewFromDir(filepath.Join(os.TempDir(), "glean-missing-dir"))
+	defer g.Close()
+	if err := g.LoadConfig(); err == nil {
+		t.Errorf("expect an error for a missing directory")
+	}
+}
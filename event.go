@@ -0,0 +1,94 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+// EventType is the kind of an Event.
+type EventType int
+
+const (
+	// EventAdded a new item has been opened and activated.
+	EventAdded EventType = iota
+	// EventChanged an existing item has been replaced by a new one.
+	EventChanged
+	// EventRemoved an item has been removed.
+	EventRemoved
+	// EventReloaded a watched function or variable has been reloaded.
+	EventReloaded
+	// EventFailed an item failed to be opened, validated or reloaded.
+	EventFailed
+	// EventApplied a set of changes has been applied. It is sent after the events of the items.
+	EventApplied
+	// EventPanicked a bound function panicked and the panic is recovered. Err is a *PluginPanicError.
+	EventPanicked
+	// EventRolledBack an item is rolled back automatically and its bad version is quarantined.
+	// Item is the bad version and Err is why.
+	EventRolledBack
+	// EventShadowMismatch the shadow of an item returned different results from the current version.
+	// Item is the shadow and Err is a *ShadowMismatchError.
+	EventShadowMismatch
+)
+
+var eventTypeNames = [...]string{
+	EventAdded:          "added",
+	EventChanged:        "changed",
+	EventRemoved:        "removed",
+	EventReloaded:       "reloaded",
+	EventFailed:         "failed",
+	EventApplied:        "applied",
+	EventPanicked:       "panicked",
+	EventRolledBack:     "rolled_back",
+	EventShadowMismatch: "shadow_mismatch",
+}
+
+func (t EventType) String() string {
+	if int(t) < len(eventTypeNames) {
+		return eventTypeNames[t]
+	}
+	return "unknown"
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// Event describes what happened to a plugin item.
+type Event struct {
+	Type EventType
+	// ID is the id of the item.
+	ID string
+	// Item is the item that the event is about.
+	Item *PluginItem
+	// Change explains why the item is changed. It is set for items that exist before.
+	Change *ItemChange
+	// Changes is the whole ChangeSet. It is only set for EventApplied.
+	Changes *ChangeSet
+	// Err is set for EventFailed, EventPanicked, EventRolledBack and EventShadowMismatch.
+	Err error
+}
+
+// OnEvent registers a handler that is called after items are added, changed, removed or reloaded.
+// Handlers are called synchronously and outside of Glean's lock, so they may call methods of Glean.
+func (g *Glean) OnEvent(fn func(Event)) {
+	g.mu.Lock()
+	g.handlers = append(g.handlers, fn)
+	g.mu.Unlock()
+}
+
+func (g *Glean) emit(events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	g.mu.RLock()
+	handlers := g.handlers
+	g.mu.RUnlock()
+
+	for _, e := range events {
+		for _, fn := range handlers {
+			fn(e)
+		}
+	}
+}
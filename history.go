@@ -0,0 +1,171 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/smallnest/glean/metrics"
+)
+
+// defaultHistorySize is how many entries are kept for every item by default.
+const defaultHistorySize = 10
+
+// WithHistorySize sets how many entries of History are kept for every item. The default is 10.
+func WithHistorySize(n int) Option {
+	return func(g *Glean) {
+		g.historySize = n
+	}
+}
+
+// HistoryError is returned by Rollback when the version to roll back to is not in the history of the item.
+// Version is empty if the item has no previous version.
+type HistoryError struct {
+	ID      string
+	Version string
+}
+
+func (e *HistoryError) Error() string {
+	if e.Version == "" {
+		return fmt.Sprintf("%s has no previous version", e.ID)
+	}
+	return fmt.Sprintf("version %s of %s is not in the history", e.Version, e.ID)
+}
+
+// HistoryEntry is a version of an item that has been swapped in or removed.
+type HistoryEntry struct {
+	Generation uint64     `json:"generation"`
+	Time       time.Time  `json:"time"`
+	Type       EventType  `json:"type"`
+	Item       PluginItem `json:"item"`
+	// Hash is the sha256 of the plugin file of Item.
+	Hash string `json:"hash,omitempty"`
+}
+
+// History returns the entries of the item from the oldest to the latest.
+// If id is empty, the entries of all items are returned by generation.
+func (g *Glean) History(id string) []HistoryEntry {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if id != "" {
+		return append([]HistoryEntry(nil), g.history[id]...)
+	}
+
+	var entries []HistoryEntry
+	for _, h := range g.history {
+		entries = append(entries, h...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Generation != entries[j].Generation {
+			return entries[i].Generation < entries[j].Generation
+		}
+		return entries[i].Item.ID < entries[j].Item.ID
+	})
+	return entries
+}
+
+// recordHistoryLocked appends items that are added, changed or removed by events to their history. g.mu must be held.
+func (g *Glean) recordHistoryLocked(events []Event) {
+	if g.historySize <= 0 {
+		return
+	}
+
+	now := time.Now()
+	for _, e := range events {
+		if e.Type != EventAdded && e.Type != EventChanged && e.Type != EventRemoved {
+			continue
+		}
+		h := append(g.history[e.ID], HistoryEntry{Generation: g.generation, Time: now, Type: e.Type, Item: *e.Item, Hash: e.Item.Hash})
+		if len(h) > g.historySize {
+			h = append([]HistoryEntry(nil), h[len(h)-g.historySize:]...)
+		}
+		g.history[e.ID] = h
+	}
+}
+
+// Rollback swaps in the latest version of the item in its history that has the given version.
+// If version is empty, the version that was active before the current one is swapped in.
+// Like UpdateItem, the rollback is replaced when the config file is changed unless it is persisted.
+func (g *Glean) Rollback(id, version string) error {
+	err := g.rollback(id, version)
+	if err != nil {
+		metrics.Add("glean_rollbacks_total", 1, "id", id, "result", "error")
+	} else {
+		metrics.Add("glean_rollbacks_total", 1, "id", id, "result", "ok")
+	}
+	return err
+}
+
+func (g *Glean) rollback(id, version string) error {
+	g.mu.RLock()
+	h := g.history[id]
+	var current string
+	if item := g.idMap[id]; item != nil {
+		current = item.Hash + "@" + item.Version
+	}
+	g.mu.RUnlock()
+
+	var target *PluginItem
+	for i := len(h) - 1; i >= 0 && target == nil; i-- {
+		e := h[i]
+		if e.Type == EventRemoved {
+			continue
+		}
+		if (version == "" && e.Item.Hash+"@"+e.Item.Version != current) || (version != "" && e.Item.Version == version) {
+			item := e.Item
+			target = &item
+		}
+	}
+	if target == nil {
+		return &HistoryError{ID: id, Version: version}
+	}
+
+	file, err := g.versionFile(target)
+	if err != nil {
+		return err
+	}
+	target.File = file
+	target.Cached, target.Generation, target.Plugin, target.expandedFrom = nil, 0, "", nil
+
+	return g.modifyItems(func(items []*PluginItem) ([]*PluginItem, error) {
+		for i, it := range items {
+			if it.ID == id {
+				items[i] = target
+				return items, nil
+			}
+		}
+		return append(items, target), nil
+	})
+}
+
+// versionFile returns the plugin file that has the content of item.Hash.
+// If the file has been rebuilt since then, a copy named by the hash is used.
+func (g *Glean) versionFile(item *PluginItem) (string, error) {
+	if item.Hash == "" {
+		return item.File, nil
+	}
+	if h, _ := hashFile(item.File); h == item.Hash {
+		return item.File, nil
+	}
+
+	ext := filepath.Ext(item.File)
+	var copies []string
+	if cp, err := pluginCopy(item.Hash, ext); err == nil {
+		copies = append(copies, cp)
+	}
+	if g.stateDir != "" {
+		copies = append(copies, filepath.Join(g.stateDir, "plugins", item.Hash+ext))
+	}
+	for _, cp := range copies {
+		if h, _ := hashFile(cp); h == item.Hash {
+			return cp, nil
+		}
+	}
+	return "", fmt.Errorf("%s has been rebuilt since version %s of %s was loaded", item.File, item.Version, item.ID)
+}
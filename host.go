@@ -0,0 +1,86 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"encoding/json"
+	"plugin"
+
+	"github.com/smallnest/glean/log"
+	"github.com/smallnest/glean/metrics"
+)
+
+// Host is the services that the host offers to plugins.
+// It is passed to lifecycle functions of plugins declared as func(context.Context, H) error,
+// where H is Host or any interface that Host implements, so plugins can declare only what they use.
+type Host interface {
+	// Logger returns the logger of the host.
+	Logger() log.Logger
+	// Metrics returns the metrics registry of the host.
+	Metrics() metrics.Metrics
+	// Params returns params of the item by ID.
+	Params(id string) json.RawMessage
+	// Lookup returns the symbol of another item by ID from the current snapshot.
+	Lookup(id string) (interface{}, error)
+}
+
+type host struct {
+	g *Glean
+	// item is the item that is being loaded. Its generation is 0 until it is swapped in.
+	item *PluginItem
+}
+
+func (h *host) Logger() log.Logger {
+	return log.GetLogger()
+}
+
+func (h *host) Metrics() metrics.Metrics {
+	return metrics.GetMetrics()
+}
+
+// Params returns params of the item that is being loaded until it is swapped in. Otherwise it reads items prepared
+// in the current reload pass and the snapshot, so a plugin that keeps the Host sees params that are changed later.
+func (h *host) Params(id string) json.RawMessage {
+	if h.item != nil && h.item.ID == id && h.item.Generation == 0 {
+		return h.item.Params
+	}
+	if si, ok := h.g.getPending(id); ok {
+		return si.item.Params
+	}
+	item, _ := h.g.Snapshot().Item(id)
+	return item.Params
+}
+
+// Lookup reads items prepared in the current reload pass and the snapshot rather than items of Glean,
+// because it is called while Glean is applying changes.
+func (h *host) Lookup(id string) (interface{}, error) {
+	if si, ok := h.g.getPending(id); ok {
+		return si.sym, nil
+	}
+	return h.g.Snapshot().Lookup(id)
+}
+
+// setPending makes a prepared item visible to plugins that are started later in the same reload pass.
+func (g *Glean) setPending(item *PluginItem, sym plugin.Symbol) {
+	g.pendingMu.Lock()
+	if g.pending == nil {
+		g.pending = make(map[string]snapshotItem)
+	}
+	g.pending[item.ID] = snapshotItem{item: *item, sym: sym}
+	g.pendingMu.Unlock()
+}
+
+func (g *Glean) getPending(id string) (snapshotItem, bool) {
+	g.pendingMu.Lock()
+	si, ok := g.pending[id]
+	g.pendingMu.Unlock()
+	return si, ok
+}
+
+func (g *Glean) clearPending() {
+	g.pendingMu.Lock()
+	g.pending = nil
+	g.pendingMu.Unlock()
+}
@@ -0,0 +1,95 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/smallnest/glean/log"
+)
+
+func TestLifecycleFunc(t *testing.T) {
+	h := &host{g: New("plugin_test.json")}
+
+	ctxOnly := func(ctx context.Context) error { return nil }
+	withHost := func(ctx context.Context, h Host) error { return nil }
+	withPart := func(ctx context.Context, h interface{ Logger() log.Logger }) error { return nil }
+	withOther := func(ctx context.Context, h interface{ Close() error }) error { return nil }
+	noCtx := func() error { return nil }
+
+	tests := []struct {
+		name string
+		s    interface{}
+		ok   bool
+	}{
+		{"ctx only", ctxOnly, true},
+		{"ctx only var", &ctxOnly, true},
+		{"host", withHost, true},
+		{"part of host", withPart, true},
+		{"other interface", withOther, false},
+		{"no ctx", noCtx, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn, ok := lifecycleFunc(tt.s, h)
+			if ok != tt.ok {
+				t.Fatalf("lifecycleFunc() ok = %v, want %v", ok, tt.ok)
+			}
+			if ok {
+				if err := fn(context.Background()); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestGlean_Host(t *testing.T) {
+	log.SetDummyLogger()
+
+	g := New("plugin_test.json")
+	defer g.Close()
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	err := g.AddItem(PluginItem{ID: "hostv", File: "_example/test/plugins/plugin3/plugin3.so", Name: "HostV", Params: json.RawMessage(`{"threshold":2}`)})
+	if err != nil {
+		t.Fatalf("failed to add item: %v", err)
+	}
+
+	var hostV func() int
+	if err = g.Reload("hostv", &hostV); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if hostV() != 100 {
+		t.Errorf("expect plugin3 to look up V=100 from the host but got %d", hostV())
+	}
+
+	h := &host{g: g}
+	if string(h.Params("hostv")) != `{"threshold":2}` {
+		t.Errorf("unexpected params: %s", h.Params("hostv"))
+	}
+
+	// a Host kept by the plugin sees params that are changed without restarting the plugin.
+	g.mu.RLock()
+	h = &host{g: g, item: g.idMap["hostv"]}
+	g.mu.RUnlock()
+	err = g.UpdateItem(PluginItem{ID: "hostv", File: "_example/test/plugins/plugin3/plugin3.so", Name: "HostV", Params: json.RawMessage(`{"threshold":4}`)})
+	if err != nil {
+		t.Fatalf("failed to update item: %v", err)
+	}
+	if string(h.Params("hostv")) != `{"threshold":4}` {
+		t.Errorf("expect changed params but got %s", h.Params("hostv"))
+	}
+
+	// the item that is being loaded is used until it is swapped in.
+	h = &host{g: g, item: &PluginItem{ID: "new", Params: json.RawMessage(`{"threshold":5}`)}}
+	if string(h.Params("new")) != `{"threshold":5}` {
+		t.Errorf("expect params of the loading item but got %s", h.Params("new"))
+	}
+}
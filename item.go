@@ -0,0 +1,219 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/smallnest/glean/log"
+)
+
+// AddItem opens a new plugin item and activates it without editing the config file.
+// If Glean is created WithPersist, the resulting items are written back to the config file.
+func (g *Glean) AddItem(item PluginItem) error {
+	return g.modifyItems(func(items []*PluginItem) ([]*PluginItem, error) {
+		for _, it := range items {
+			if it.ID == item.ID {
+				return nil, ErrItemExists
+			}
+		}
+		return append(items, &item), nil
+	})
+}
+
+// UpdateItem replaces the configured item that has the same ID.
+func (g *Glean) UpdateItem(item PluginItem) error {
+	return g.modifyItems(func(items []*PluginItem) ([]*PluginItem, error) {
+		for i, it := range items {
+			if it.ID == item.ID {
+				items[i] = &item
+				return items, nil
+			}
+		}
+		return nil, ErrItemHasNotConfigured
+	})
+}
+
+// RemoveItem removes the configured item by id.
+func (g *Glean) RemoveItem(id string) error {
+	return g.modifyItems(func(items []*PluginItem) ([]*PluginItem, error) {
+		for i, it := range items {
+			if it.ID == id {
+				if it.expandedFrom != nil && g.persist {
+					return nil, fmt.Errorf("%s is listed by the manifest of %s, so it can only be disabled", id, it.File)
+				}
+				return append(items[:i], items[i+1:]...), nil
+			}
+		}
+		return nil, ErrItemHasNotConfigured
+	})
+}
+
+// SetItemEnabled enables or disables the configured item by id. A disabled item is stopped and unbound but kept,
+// so it can be enabled again, and a function or variable watched on it is bound again then. See PluginItem.Enabled.
+// Like UpdateItem, the change is replaced when the config file is changed unless it is persisted.
+func (g *Glean) SetItemEnabled(id string, enabled bool) error {
+	return g.modifyItems(func(items []*PluginItem) ([]*PluginItem, error) {
+		for _, it := range items {
+			if it.ID == id {
+				it.expandedFrom = nil // the item is configured explicitly from now on.
+				if enabled {
+					it.Enabled = nil
+				} else {
+					it.Enabled = &enabled
+				}
+				return items, nil
+			}
+		}
+		return nil, ErrItemHasNotConfigured
+	})
+}
+
+// ReloadItem checks the plugin file of the configured item by id and swaps the item in if the file has been rebuilt.
+// An item that failed to load is retried, such as after its plugin is fixed.
+// Like the other methods that modify items, it applies all current items, so other rebuilt plugins are swapped in too.
+func (g *Glean) ReloadItem(id string) error {
+	return g.modifyItems(func(items []*PluginItem) ([]*PluginItem, error) {
+		for _, it := range items {
+			if it.ID == id {
+				return items, nil
+			}
+		}
+		return nil, ErrItemHasNotConfigured
+	})
+}
+
+// modifyItems applies fn to a copy of configured items, including those that failed to load,
+// and runs the result through the same pipeline as config changes.
+// The returned error includes errors of configured items that still fail to load.
+// Notice items added by this way are removed when the config file is changed unless they are persisted.
+func (g *Glean) modifyItems(fn func([]*PluginItem) ([]*PluginItem, error)) error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return ErrClosed
+	}
+
+	// skipped items are kept so that they are not lost when items are persisted.
+	items := make([]*PluginItem, 0, len(g.configured)+len(g.skipped)+1)
+	for _, item := range g.configured {
+		cp := *item
+		items = append(items, &cp)
+	}
+	for _, item := range g.skipped {
+		cp := *item
+		items = append(items, &cp)
+	}
+
+	if g.persist {
+		if err := g.checkPersistableLocked(); err != nil {
+			g.mu.Unlock()
+			return err
+		}
+	}
+
+	items, err := fn(items)
+	if err != nil {
+		g.mu.Unlock()
+		return err
+	}
+
+	events, err := g.applyLocked(items)
+	// items that fail to load are persisted as they are configured, unless the items are refused as a whole.
+	if g.persist && (err == nil || len(events) > 0) {
+		if e := g.persistLocked(); e != nil {
+			err = multierror.Append(err, e)
+		}
+	}
+	g.mu.Unlock()
+
+	g.emit(events...)
+	return err
+}
+
+// persistLocked writes configured and skipped items to the config file as they are configured. g.mu must be held.
+func (g *Glean) persistLocked() error {
+	if g.configFile == "" {
+		return ErrNoConfigFile
+	}
+
+	var items []*PluginItem
+	written := make(map[*PluginItem]bool)
+	for _, item := range append(append([]*PluginItem{}, g.configured...), g.skipped...) {
+		if item.expandedFrom != nil {
+			// items expanded from the same manifest are written as the item they are expanded from.
+			item = item.expandedFrom
+		}
+		if written[item] {
+			continue
+		}
+		written[item] = true
+		cp := *item
+		cp.clearManifestFields()
+		items = append(items, &cp)
+	}
+	buf, err := json.MarshalIndent(items, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(g.configFile, buf)
+	if err != nil {
+		log.Errorf("failed to persist %s: %v", g.configFile, err)
+	}
+	return err
+}
+
+// checkPersistableLocked returns ErrConfigNotPersistable if the config file uses profiles or ${VAR},
+// which would be lost if items were written back. g.mu must be held.
+func (g *Glean) checkPersistableLocked() error {
+	if g.configFile == "" {
+		return ErrNoConfigFile
+	}
+	buf, err := ioutil.ReadFile(g.configFile)
+	if err != nil {
+		return err
+	}
+	if usesTemplates(buf) {
+		return ErrConfigNotPersistable
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and renames it to file.
+func writeFileAtomic(file string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		mode := os.FileMode(0644)
+		if fi, e := os.Stat(file); e == nil {
+			mode = fi.Mode()
+		}
+		err = os.Chmod(tmp, mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
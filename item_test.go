@@ -0,0 +1,257 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/smallnest/glean/log"
+)
+
+func copyConfig(t *testing.T, src string) string {
+	buf, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", src, err)
+	}
+
+	dir, err := ioutil.TempDir("", "glean")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+
+	file := filepath.Join(dir, "plugin.json")
+	if err = ioutil.WriteFile(file, buf, 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", file, err)
+	}
+	return file
+}
+
+func TestGlean_ManageItems(t *testing.T) {
+	log.SetDummyLogger()
+
+	file := copyConfig(t, "plugin_test.json")
+	defer os.RemoveAll(filepath.Dir(file))
+
+	g := New(file, WithPersist())
+	defer g.Close()
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	var events []Event
+	g.OnEvent(func(e Event) {
+		events = append(events, e)
+	})
+
+	var fn func(x, y int) int
+	if err := g.ReloadAndWatch("EF5A35EC-46EB-4E62-8251-78F1A49FA7DC", &fn); err != nil {
+		t.Fatalf("failed to reload fn: %v", err)
+	}
+	if got := fn(1, 2); got != 30 {
+		t.Errorf("expect plugin2 Add to return 30 but got %d", got)
+	}
+
+	err := g.AddItem(PluginItem{ID: "sub", File: "_example/test/plugins/plugin1/plugin1.so", Name: "Add", Version: "1.0"})
+	if err != nil {
+		t.Fatalf("failed to add item: %v", err)
+	}
+	if err = g.AddItem(PluginItem{ID: "sub", File: "_example/test/plugins/plugin1/plugin1.so", Name: "Add"}); err != ErrItemExists {
+		t.Errorf("expect ErrItemExists but got %v", err)
+	}
+
+	err = g.UpdateItem(PluginItem{ID: "EF5A35EC-46EB-4E62-8251-78F1A49FA7DC", File: "_example/test/plugins/plugin1/plugin1.so", Name: "Add", Version: "1.1"})
+	if err != nil {
+		t.Fatalf("failed to update item: %v", err)
+	}
+	if got := fn(1, 2); got != 3 {
+		t.Errorf("expect plugin1 Add to return 3 but got %d", got)
+	}
+
+	err = g.UpdateItem(PluginItem{ID: "EF5A35EC-46EB-4E62-8251-78F1A49FA7DC", File: "_example/test/plugins/pluginabc/plugin1.so", Name: "Add"})
+	if err == nil {
+		t.Errorf("expect an error for a non-existed plugin")
+	}
+	if got := fn(1, 2); got != 3 {
+		t.Errorf("failed update must keep plugin1 Add but got %d", got)
+	}
+	// the failed item is retried by every change until it is fixed.
+	err = g.UpdateItem(PluginItem{ID: "EF5A35EC-46EB-4E62-8251-78F1A49FA7DC", File: "_example/test/plugins/plugin1/plugin1.so", Name: "Add", Version: "1.1"})
+	if err != nil {
+		t.Fatalf("failed to fix item: %v", err)
+	}
+
+	if err = g.RemoveItem("sub"); err != nil {
+		t.Fatalf("failed to remove item: %v", err)
+	}
+	if err = g.RemoveItem("sub"); err != ErrItemHasNotConfigured {
+		t.Errorf("expect ErrItemHasNotConfigured but got %v", err)
+	}
+
+	// the watcher may retry the failed item when it sees the persisted config, so repeated events are counted once.
+	var types []EventType
+	for _, e := range events {
+		if e.Type != EventApplied && (len(types) == 0 || types[len(types)-1] != e.Type) {
+			types = append(types, e.Type)
+		}
+	}
+	want := []EventType{EventAdded, EventChanged, EventReloaded, EventFailed, EventRemoved}
+	if len(types) != len(want) {
+		t.Fatalf("expect events %v but got %v", want, types)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("expect events %v but got %v", want, types)
+		}
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("failed to read persisted config: %v", err)
+	}
+	var persisted []*PluginItem
+	if err = json.Unmarshal(buf, &persisted); err != nil {
+		t.Fatalf("failed to unmarshal persisted config: %v", err)
+	}
+	if len(persisted) != 2 || persisted[0].Version != "1.1" {
+		t.Errorf("unexpected persisted config: %s", buf)
+	}
+}
+
+func TestGlean_PersistConfig(t *testing.T) {
+	log.SetDummyLogger()
+
+	so := "_example/test/plugins/plugin3/plugin3.so"
+	tests := []struct {
+		name    string
+		config  string
+		wantErr error
+		want    string
+	}{
+		{
+			name:    "variable",
+			config:  `[{"id":"t","file":"${PLUGIN_DIR}/plugin3.so","name":"Threshold"}]`,
+			wantErr: ErrConfigNotPersistable,
+		},
+		{
+			name:    "profiles",
+			config:  `{"items":[{"id":"t","file":"` + so + `","name":"Threshold"}],"profiles":{"prod":[]}}`,
+			wantErr: ErrConfigNotPersistable,
+		},
+		{
+			name:   "manifest fields",
+			config: `[{"file":"` + so + `"},{"id":"t","file":"` + so + `","name":"Threshold"}]`,
+			want:   `[{"file":"` + so + `"},{"id":"t","file":"` + so + `","name":"Threshold"},{"id":"sub","file":"` + so + `","name":"Calls","version":"1.0"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("PLUGIN_DIR", "_example/test/plugins/plugin3")
+			defer os.Unsetenv("PLUGIN_DIR")
+
+			dir, err := ioutil.TempDir("", "glean")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			file := filepath.Join(dir, "plugin.json")
+			if err = ioutil.WriteFile(file, []byte(tt.config), 0644); err != nil {
+				t.Fatalf("failed to write %s: %v", file, err)
+			}
+
+			g := New(file, WithPersist())
+			defer g.Close()
+			if err = g.LoadConfig(); err != nil {
+				t.Fatalf("failed to load config: %v", err)
+			}
+
+			err = g.AddItem(PluginItem{ID: "sub", File: so, Name: "Calls", Version: "1.0"})
+			if err != tt.wantErr {
+				t.Fatalf("expect %v but got %v", tt.wantErr, err)
+			}
+			buf, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatalf("failed to read persisted config: %v", err)
+			}
+			if tt.wantErr != nil {
+				if string(buf) != tt.config {
+					t.Errorf("expect the config to be kept but got %s", buf)
+				}
+				return
+			}
+
+			var got, want []*PluginItem
+			if err = json.Unmarshal(buf, &got); err != nil {
+				t.Fatalf("failed to unmarshal persisted config: %v", err)
+			}
+			json.Unmarshal([]byte(tt.want), &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("expect persisted config %s but got %s", tt.want, buf)
+			}
+
+			if err = g.RemoveItem("plugin3.calls"); err == nil {
+				t.Errorf("expect an error for removing an item listed by a manifest")
+			}
+		})
+	}
+}
+
+func TestGlean_PersistFailedItem(t *testing.T) {
+	log.SetDummyLogger()
+
+	dir, err := ioutil.TempDir("", "glean")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "plugin.json")
+	config := `[{"id":"add","file":"_example/test/plugins/plugin1/plugin1.so","name":"Add"},
+		{"id":"broken","file":"_example/test/plugins/missing.so","name":"Add"}]`
+	if err = ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", file, err)
+	}
+
+	g := New(file, WithPersist())
+	defer g.Close()
+	if err = g.LoadConfig(); err == nil {
+		t.Fatal("expect an error for the missing plugin")
+	}
+
+	// the failed item is kept, so it is persisted and still reported.
+	err = g.AddItem(PluginItem{ID: "sub", File: "_example/test/plugins/plugin1/plugin1.so", Name: "Add", Version: "1.0"})
+	if err == nil {
+		t.Errorf("expect the error of the failed item")
+	}
+	err = g.UpdateItem(PluginItem{ID: "broken", File: "_example/test/plugins/missing.so", Name: "Add", Version: "1.1"})
+	if err == nil {
+		t.Errorf("expect the error of the failed item")
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("failed to read persisted config: %v", err)
+	}
+	var persisted []*PluginItem
+	if err = json.Unmarshal(buf, &persisted); err != nil {
+		t.Fatalf("failed to unmarshal persisted config: %v", err)
+	}
+	if len(persisted) != 3 || persisted[1].ID != "broken" || persisted[1].Version != "1.1" || persisted[2].ID != "sub" {
+		t.Errorf("unexpected persisted config: %s", buf)
+	}
+
+	var found bool
+	for _, st := range g.Status() {
+		if st.ID == "broken" {
+			found = st.Error != "" && st.Version == "1.1"
+		}
+	}
+	if !found {
+		t.Errorf("expect the failed item in status: %+v", g.Status())
+	}
+}
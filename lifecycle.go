@@ -0,0 +1,148 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"context"
+	"fmt"
+	"plugin"
+	"reflect"
+
+	"github.com/smallnest/glean/log"
+)
+
+// Names of optional lifecycle functions exported by plugins.
+// They must be func(context.Context) error or func(context.Context, Host) error.
+// GleanInit and GleanStart are called in order when a plugin is opened by its first item,
+// and an item is not activated if either of them fails.
+// GleanStop is called when no active item uses the plugin any more, that is,
+// its items have been replaced by another version or removed, or Glean is closed.
+// They are called while Glean is applying changes, so they must not call methods of Glean.
+const (
+	InitSymbol  = "GleanInit"
+	StartSymbol = "GleanStart"
+	StopSymbol  = "GleanStop"
+)
+
+// startPluginLocked calls GleanInit and GleanStart of the plugin of item if it has not been started. g.mu must be held.
+func (g *Glean) startPluginLocked(item *PluginItem) error {
+	pp, file := item.Cached, item.File
+	if _, ok := g.plugins[pp]; ok {
+		return nil
+	}
+
+	h := &host{g: g, item: item}
+	if err := g.callLifecycle(pp, file, InitSymbol, h); err != nil {
+		return err
+	}
+	if err := g.callLifecycle(pp, file, StartSymbol, h); err != nil {
+		g.callLifecycle(pp, file, StopSymbol, h)
+		return err
+	}
+
+	g.plugins[pp] = file
+	return nil
+}
+
+// restartPluginLocked calls GleanStop, GleanInit and GleanStart of the plugin of item. g.mu must be held.
+func (g *Glean) restartPluginLocked(item *PluginItem) error {
+	if file, ok := g.plugins[item.Cached]; ok {
+		delete(g.plugins, item.Cached)
+		g.callLifecycle(item.Cached, file, StopSymbol, &host{g: g, item: item})
+	}
+	return g.startPluginLocked(item)
+}
+
+// stopUnusedPluginsLocked calls GleanStop of started plugins that are not used by any active item. g.mu must be held.
+func (g *Glean) stopUnusedPluginsLocked() {
+	used := make(map[*plugin.Plugin]bool)
+	for _, item := range g.idMap {
+		used[item.Cached] = true
+		if item.Canary != nil {
+			used[item.Canary.Cached] = true
+		}
+	}
+	// calls that panic are retried on the previous version by Fallback.
+	for id, b := range g.bindings {
+		if b != nil && g.watched[id] && b.fallback && b.prev != nil {
+			used[b.prev.item.Cached] = true
+		}
+	}
+
+	for pp, file := range g.plugins {
+		if !used[pp] {
+			delete(g.plugins, pp)
+			g.callLifecycle(pp, file, StopSymbol, &host{g: g})
+		}
+	}
+}
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// lifecycleFunc adapts the lifecycle symbol s to a func(context.Context) error.
+// It returns false if s is neither func(context.Context) error nor func(context.Context, H) error
+// where h can be assigned to H.
+func lifecycleFunc(s plugin.Symbol, h Host) (func(context.Context) error, bool) {
+	v := symbolValue(s)
+	if fn, ok := v.Interface().(func(context.Context) error); ok {
+		return fn, true
+	}
+
+	t := v.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.NumOut() != 1 ||
+		t.In(0) != contextType || t.Out(0) != errorType || !reflect.TypeOf(h).AssignableTo(t.In(1)) {
+		return nil, false
+	}
+
+	return func(ctx context.Context) error {
+		out := v.Call([]reflect.Value{reflect.ValueOf(&ctx).Elem(), reflect.ValueOf(h)})
+		err, _ := out[0].Interface().(error)
+		return err
+	}, true
+}
+
+// callLifecycle calls the lifecycle function name of pp with a timeout. A missing function is ignored.
+func (g *Glean) callLifecycle(pp *plugin.Plugin, file, name string, h Host) (err error) {
+	s, err := pp.Lookup(name)
+	if err != nil {
+		return nil
+	}
+
+	fn, ok := lifecycleFunc(s, h)
+	if !ok {
+		err = fmt.Errorf("%s in %s must be func(context.Context) error or func(context.Context, glean.Host) error", name, file)
+		log.Error(err)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("%s of %s panics: %v", name, file, r)
+			}
+		}()
+		done <- fn(ctx)
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		log.Errorf("failed to call %s of %s: %v", name, file, err)
+	} else {
+		log.Infof("%s of %s is called", name, file)
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/smallnest/glean/log"
+)
+
+func TestGlean_Lifecycle(t *testing.T) {
+	log.SetDummyLogger()
+
+	file := copyConfig(t, "plugin_test.json")
+	defer os.RemoveAll(filepath.Dir(file))
+
+	g := New(file)
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	callsSym, err := LoadSymbol("_example/test/plugins/plugin3/plugin3.so", "Calls")
+	if err != nil {
+		t.Fatalf("failed to load Calls: %v", err)
+	}
+	calls := callsSym.(func() []string)
+	calls()
+
+	so := "_example/test/plugins/plugin3/plugin3.so"
+	tests := []struct {
+		name    string
+		fn      func() error
+		wantErr bool
+		want    []string
+	}{
+		{
+			name: "add first item",
+			fn: func() error {
+				return g.AddItem(PluginItem{ID: "t1", File: so, Name: "Threshold", Params: json.RawMessage(`{"threshold":1}`)})
+			},
+			want: []string{"init", "start"},
+		},
+		{
+			name: "add second item",
+			fn: func() error {
+				return g.AddItem(PluginItem{ID: "t2", File: so, Name: "Threshold"})
+			},
+		},
+		{
+			name: "remove first item",
+			fn:   func() error { return g.RemoveItem("t1") },
+		},
+		{
+			name: "remove last item",
+			fn:   func() error { return g.RemoveItem("t2") },
+			want: []string{"stop"},
+		},
+		{
+			name: "init fails",
+			fn: func() error {
+				return g.AddItem(PluginItem{ID: "t3", File: so, Name: "Threshold", Params: json.RawMessage(`{"threshold":1000}`)})
+			},
+			wantErr: true,
+			want:    []string{"init"},
+		},
+		{
+			name: "close",
+			fn: func() error {
+				if err := g.RemoveItem("t3"); err != nil {
+					return err
+				}
+				if err := g.AddItem(PluginItem{ID: "t4", File: so, Name: "Threshold", Params: json.RawMessage(`{"threshold":1}`)}); err != nil {
+					return err
+				}
+				g.Close()
+				return nil
+			},
+			want: []string{"init", "start", "stop"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.fn(); (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := calls(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("calls = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, ok := g.idMap["t3"]; ok {
+		t.Errorf("item whose init fails must not be activated")
+	}
+}
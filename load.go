@@ -5,11 +5,18 @@
 package glean
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"plugin"
 	"reflect"
 	"runtime"
+	"sync"
+	"time"
 
 	"github.com/smallnest/glean/log"
+	"github.com/smallnest/glean/metrics"
 )
 
 // LoadSymbol loads a plugin and gets the symbol.
@@ -30,67 +37,195 @@ func LoadSymbol(so, name string) (interface{}, error) {
 	return v, nil
 }
 
+var (
+	openedMu sync.Mutex
+	// opened records the content hash of plugin files that have been opened.
+	opened = make(map[string]string)
+	// byHash records plugins by the content hash of their files.
+	byHash = make(map[string]*plugin.Plugin)
+	// copyDir is the private directory of copies of rebuilt plugins. It is created when the first copy is made.
+	copyDir string
+)
+
+// openPlugin opens the plugin file whose content hash is hash.
+// The Go runtime never unloads a plugin and always returns the first one opened from a path,
+// so a file that has been rebuilt in place is opened from a copy named by its hash in a directory
+// that is only accessible by the owner.
+// The rebuilt plugin must be built with a different -pluginpath.
+// A file that has the same content as an opened one, such as a copy in the state directory,
+// returns the opened plugin because the runtime refuses to load a plugin twice.
+func openPlugin(file, hash string) (*plugin.Plugin, error) {
+	if hash == "" {
+		return timedOpen(file)
+	}
+
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+
+	openedMu.Lock()
+	first, ok := opened[abs]
+	pp := byHash[hash]
+	openedMu.Unlock()
+
+	if pp != nil {
+		return pp, nil
+	}
+
+	if ok && first != hash {
+		cp, err := copyPlugin(file, hash)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("%s has been rebuilt, open it from %s", file, cp)
+		file = cp
+	}
+
+	p, err := timedOpen(file)
+	if err == nil {
+		openedMu.Lock()
+		if !ok {
+			opened[abs] = hash
+		}
+		byHash[hash] = p
+		openedMu.Unlock()
+	}
+	return p, err
+}
+
+// timedOpen opens the plugin and records the latency and the result.
+func timedOpen(file string) (*plugin.Plugin, error) {
+	start := time.Now()
+	p, err := plugin.Open(file)
+	metrics.Observe("glean_plugin_open_seconds", time.Since(start).Seconds())
+	if err != nil {
+		metrics.Add("glean_plugin_opens_total", 1, "result", "error")
+	} else {
+		metrics.Add("glean_plugin_opens_total", 1, "result", "ok")
+	}
+	return p, err
+}
+
+// copyPlugin copies the plugin file whose content hash is hash to its private copy, unless the copy exists.
+func copyPlugin(file, hash string) (string, error) {
+	cp, err := pluginCopy(hash, filepath.Ext(file))
+	if err != nil {
+		return "", err
+	}
+	if h, _ := hashFile(cp); h == hash {
+		return cp, nil
+	}
+
+	if err = copyFile(file, cp); err != nil {
+		return "", err
+	}
+	// the file may have been rebuilt again since it was hashed.
+	if h, err := hashFile(cp); err != nil || h != hash {
+		os.Remove(cp)
+		return "", fmt.Errorf("%s has been changed while it is copied", file)
+	}
+	return cp, nil
+}
+
+// pluginCopy returns the path of the copy of a plugin file whose content hash is hash.
+func pluginCopy(hash, ext string) (string, error) {
+	openedMu.Lock()
+	defer openedMu.Unlock()
+
+	if copyDir == "" {
+		dir, err := ioutil.TempDir("", "glean-plugins-") // created with 0700
+		if err != nil {
+			return "", err
+		}
+		copyDir = dir
+	}
+	return filepath.Join(copyDir, hash+ext), nil
+}
+
+func copyFile(src, dst string) error {
+	buf, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, buf)
+}
+
 // Reload loads a function or a variable from the plugin and replace passed function or variable.
 // If fails to load, the original function or variable won't be replaced.
 func Reload(so, name string, vPtr interface{}) error {
-	var err error
-	defer func() {
-		if r := recover(); r != nil {
-			if _, ok := r.(runtime.Error); ok {
-				panic(r)
-			}
-			err = r.(error)
-		}
-	}()
-
-	// a Symbol is a pointer to a variable or function.
+	// a Symbol is a pointer to a variable or a function.
 	s, err := LoadSymbol(so, name)
 	if err != nil {
 		return err
 	}
 
+	return assignSymbol(s, vPtr)
+}
+
+// ReloadFromPlugin is like Reload but it loads a function or a variable from the given *plugin.Plugin.
+func ReloadFromPlugin(p *plugin.Plugin, name string, vPtr interface{}) error {
+	s, err := p.Lookup(name)
+	if err != nil {
+		return err
+	}
+
+	return assignSymbol(s, vPtr)
+}
+
+// TypeMismatchError is returned when a symbol can not be assigned to the given function or variable.
+type TypeMismatchError struct {
+	Want reflect.Type
+	Got  reflect.Type
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("symbol type %v is not assignable to %v", e.Got, e.Want)
+}
+
+// symbolValue returns the function or variable that s refers to.
+// Functions are looked up as function values and variables as pointers.
+func symbolValue(s plugin.Symbol) reflect.Value {
+	sv := reflect.ValueOf(s)
+	if sv.Kind() == reflect.Ptr {
+		return sv.Elem()
+	}
+	return sv
+}
+
+// checkSymbol checks whether the symbol s can be assigned to the function or variable vPtr points to.
+func checkSymbol(s plugin.Symbol, vPtr interface{}) error {
 	vPtrV := reflect.ValueOf(vPtr)
 	if vPtrV.Kind() != reflect.Ptr {
 		return ErrMustBePointer
 	}
 
 	v := vPtrV.Elem()
-
 	if !v.CanSet() {
 		return ErrValueCanNotSet
 	}
 
-	v.Set(reflect.ValueOf(s).Elem())
+	sv := symbolValue(s)
+	if !sv.Type().AssignableTo(v.Type()) {
+		return &TypeMismatchError{Want: v.Type(), Got: sv.Type()}
+	}
 	return nil
 }
 
-// ReloadFromPlugin is like Reload but it loads a function or a variable from the given *plugin.Plugin.
-func ReloadFromPlugin(p *plugin.Plugin, name string, vPtr interface{}) error {
-	var err error
+func assignSymbol(s plugin.Symbol, vPtr interface{}) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			if _, ok := r.(runtime.Error); ok {
 				panic(r)
 			}
-			err = r.(error)
+			err = fmt.Errorf("%v", r)
 		}
 	}()
 
-	s, err := p.Lookup(name)
-	if err != nil {
+	if err = checkSymbol(s, vPtr); err != nil {
 		return err
 	}
 
-	vPtrV := reflect.ValueOf(vPtr)
-	if vPtrV.Kind() != reflect.Ptr {
-		return ErrMustBePointer
-	}
-
-	v := vPtrV.Elem()
-	if !v.CanSet() {
-		return ErrValueCanNotSet
-	}
-
-	v.Set(reflect.ValueOf(s).Elem())
+	reflect.ValueOf(vPtr).Elem().Set(symbolValue(s))
 	return nil
 }
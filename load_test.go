@@ -5,6 +5,9 @@
 package glean
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"plugin"
 	"testing"
 
@@ -180,3 +183,36 @@ func TestReloadFromPlugin(t *testing.T) {
 		})
 	}
 }
+
+func TestCopyPlugin(t *testing.T) {
+	so := "_example/test/plugins/plugin1/plugin1.so"
+	hash, err := hashFile(so)
+	if err != nil {
+		t.Fatalf("failed to hash %s: %v", so, err)
+	}
+
+	// a file planted at the path of the copy is replaced.
+	cp, err := pluginCopy(hash, ".so")
+	if err != nil {
+		t.Fatalf("failed to get the copy path: %v", err)
+	}
+	if err = ioutil.WriteFile(cp, []byte("planted"), 0644); err != nil {
+		t.Fatalf("failed to plant %s: %v", cp, err)
+	}
+	defer os.Remove(cp)
+
+	got, err := copyPlugin(so, hash)
+	if err != nil || got != cp {
+		t.Fatalf("copyPlugin() = %s, %v, want %s", got, err, cp)
+	}
+	if h, _ := hashFile(got); h != hash {
+		t.Errorf("expect the copy to have hash %s but got %s", hash, h)
+	}
+	if fi, err := os.Stat(filepath.Dir(cp)); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("expect a private directory of copies but got %v, %v", fi, err)
+	}
+
+	if _, err = copyPlugin(so, "wrong"); err == nil {
+		t.Errorf("expect an error for a file that doesn't match its hash")
+	}
+}
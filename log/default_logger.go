@@ -53,7 +53,7 @@ func (l *defaultLogger) Fatalf(format string, v ...interface{}) {
 }
 
 func (l *defaultLogger) Panic(v ...interface{}) {
-	l.Logger.Panic(v)
+	l.Logger.Panic(v...)
 }
 
 func (l *defaultLogger) Panicf(format string, v ...interface{}) {
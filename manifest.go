@@ -0,0 +1,230 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"encoding/json"
+	"fmt"
+	"plugin"
+)
+
+// ManifestSymbol is the name of an optional variable exported by plugins to describe themselves.
+// The variable may be of any type that is marshaled to the JSON of Manifest, or a string of that JSON,
+// so plugins don't need to import glean.
+const ManifestSymbol = "GleanManifest"
+
+// Manifest describes a plugin and the symbols it exports.
+type Manifest struct {
+	Name    string          `json:"name"`
+	Version string          `json:"version"`
+	Symbols []ManifestEntry `json:"symbols"`
+	// Requires are IDs of items that all symbols of the plugin depend on.
+	Requires []string `json:"requires,omitempty"`
+}
+
+// ManifestEntry is an exported symbol in a Manifest.
+type ManifestEntry struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Type is the expected type of the symbol, such as "func(int, int) int".
+	Type string `json:"type,omitempty"`
+	// Requires are IDs of items that the symbol depends on.
+	Requires []string `json:"requires,omitempty"`
+}
+
+// entry returns the entry of the symbol name.
+func (m *Manifest) entry(name string) *ManifestEntry {
+	for i := range m.Symbols {
+		if m.Symbols[i].Name == name {
+			return &m.Symbols[i]
+		}
+	}
+	return nil
+}
+
+// ReadManifest reads the manifest exported by the plugin. It returns nil if the plugin has no manifest.
+func ReadManifest(p *plugin.Plugin) (*Manifest, error) {
+	s, err := p.Lookup(ManifestSymbol)
+	if err != nil {
+		return nil, nil
+	}
+
+	var buf []byte
+	switch v := s.(type) {
+	case *Manifest:
+		return v, nil
+	case *string:
+		buf = []byte(*v)
+	case *[]byte:
+		buf = *v
+	default:
+		buf, err = json.Marshal(symbolValue(s).Interface())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var m Manifest
+	if err = json.Unmarshal(buf, &m); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", ManifestSymbol, err)
+	}
+	return &m, nil
+}
+
+// expandManifests merges manifests of plugins with items.
+// An item that has a file but no name is replaced by all symbols listed in the manifest of the file,
+// unless an item with the same ID is configured explicitly. Other items get their empty version, description
+// type and requires from the manifest.
+// An item without a name whose plugin can't be opened or has no manifest is returned as failed.
+func expandManifests(items []*PluginItem) (expanded []*PluginItem, failed []*failure) {
+	manifests := make(map[string]*Manifest)
+	manifest := func(item *PluginItem) (*Manifest, error) {
+		if m, ok := manifests[item.File]; ok {
+			return m, nil
+		}
+		pp, err := openPlugin(item.File, item.Hash)
+		if err != nil {
+			return nil, err
+		}
+		m, err := ReadManifest(pp)
+		if err != nil {
+			return nil, err
+		}
+		manifests[item.File] = m
+		return m, nil
+	}
+
+	explicit := make(map[string]bool)
+	for _, item := range items {
+		if item != nil && item.Name != "" {
+			explicit[item.ID] = true
+		}
+	}
+
+	for _, item := range items {
+		if item == nil || item.File == "" {
+			expanded = append(expanded, item)
+			continue
+		}
+
+		m, err := manifest(item)
+		if item.Name != "" {
+			// explicit items are opened and reported later if their plugins are broken.
+			if err == nil && m != nil {
+				item.mergeManifest(m)
+			}
+			expanded = append(expanded, item)
+			continue
+		}
+
+		if err != nil {
+			failed = append(failed, &failure{item: item, err: fmt.Errorf("failed to read manifest of %s: %v", item.File, err)})
+			continue
+		}
+		if m == nil {
+			failed = append(failed, &failure{item: item, err: fmt.Errorf("item of %s has no name and the plugin has no %s", item.File, ManifestSymbol)})
+			continue
+		}
+		for _, e := range m.Symbols {
+			if explicit[e.ID] {
+				continue
+			}
+			it := *item
+			it.ID, it.Name = e.ID, e.Name
+			it.expandedFrom = item
+			it.mergeManifest(m)
+			expanded = append(expanded, &it)
+		}
+	}
+
+	return expanded, failed
+}
+
+// keepExpanded returns copies of the current items that are expanded from the failed items,
+// so they keep their current versions, unless items with the same IDs are configured.
+func keepExpanded(current, items []*PluginItem, failed []*failure) []*PluginItem {
+	if len(failed) == 0 {
+		return nil
+	}
+	ids := make(map[string]bool, len(items))
+	for _, item := range items {
+		if item != nil {
+			ids[item.ID] = true
+		}
+	}
+
+	var kept []*PluginItem
+	for _, f := range failed {
+		for _, item := range current {
+			if item.expandedFrom != nil && item.expandedFrom.File == f.item.File && !ids[item.ID] {
+				ids[item.ID] = true
+				cp := *item
+				cp.expandedFrom = f.item
+				kept = append(kept, &cp)
+			}
+		}
+	}
+	return kept
+}
+
+func (item *PluginItem) mergeManifest(m *Manifest) {
+	// fields taken from an earlier manifest are taken again, in case the plugin has been rebuilt.
+	item.clearManifestFields()
+
+	item.Plugin = m.Name
+	if item.Version == "" && m.Version != "" {
+		item.Version = m.Version
+		item.fromManifest = append(item.fromManifest, FieldVersion)
+	}
+	e := m.entry(item.Name)
+	if e != nil {
+		if item.Description == "" && e.Description != "" {
+			item.Description = e.Description
+			item.fromManifest = append(item.fromManifest, "description")
+		}
+		if item.Type == "" && e.Type != "" {
+			item.Type = e.Type
+			item.fromManifest = append(item.fromManifest, "type")
+		}
+	}
+	if len(item.Requires) == 0 {
+		item.Requires = append(item.Requires, m.Requires...)
+		if e != nil {
+			item.Requires = append(item.Requires, e.Requires...)
+		}
+		if len(item.Requires) > 0 {
+			item.fromManifest = append(item.fromManifest, FieldRequires)
+		}
+	}
+}
+
+// clearManifestFields clears the fields of item that are taken from the manifest of its plugin.
+func (item *PluginItem) clearManifestFields() {
+	for _, f := range item.fromManifest {
+		switch f {
+		case FieldVersion:
+			item.Version = ""
+		case "description":
+			item.Description = ""
+		case "type":
+			item.Type = ""
+		case FieldRequires:
+			item.Requires = nil
+		}
+	}
+	item.fromManifest = nil
+}
+
+// checkType checks the symbol s has the type declared by item.
+func checkType(item *PluginItem, s plugin.Symbol) error {
+	if item.Type == "" {
+		return nil
+	}
+	if t := symbolValue(s).Type(); t.String() != item.Type {
+		return fmt.Errorf("symbol %s in %s is %v, but %s is declared", item.Name, item.File, t, item.Type)
+	}
+	return nil
+}
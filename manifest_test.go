@@ -0,0 +1,177 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"plugin"
+	"testing"
+
+	"github.com/smallnest/glean/log"
+)
+
+func TestReadManifest(t *testing.T) {
+	tests := []struct {
+		so      string
+		want    string
+		symbols int
+	}{
+		{"_example/test/plugins/plugin1/plugin1.so", "", 0},
+		{"_example/test/plugins/plugin3/plugin3.so", "plugin3", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.so, func(t *testing.T) {
+			p, err := plugin.Open(tt.so)
+			if err != nil {
+				t.Fatalf("failed to open: %v", err)
+			}
+			m, err := ReadManifest(p)
+			if err != nil {
+				t.Fatalf("ReadManifest() error = %v", err)
+			}
+			if tt.want == "" {
+				if m != nil {
+					t.Errorf("expect no manifest but got %+v", m)
+				}
+				return
+			}
+			if m.Name != tt.want || len(m.Symbols) != tt.symbols {
+				t.Errorf("unexpected manifest %+v", m)
+			}
+		})
+	}
+}
+
+func TestGlean_Manifest(t *testing.T) {
+	log.SetDummyLogger()
+
+	g := New("plugin_test.json")
+	defer g.Close()
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	so := "_example/test/plugins/plugin3/plugin3.so"
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+		added   map[string]string
+	}{
+		{
+			name:   "expand",
+			config: `[{"file":"` + so + `"}]`,
+			added:  map[string]string{"plugin3.threshold": "Threshold", "plugin3.calls": "Calls"},
+		},
+		{
+			name:   "explicit item wins",
+			config: `[{"file":"` + so + `"},{"id":"plugin3.calls","file":"` + so + `","name":"Threshold"}]`,
+			added:  map[string]string{"plugin3.threshold": "Threshold", "plugin3.calls": "Threshold"},
+		},
+		{
+			name:    "no manifest",
+			config:  `[{"file":"_example/test/plugins/plugin1/plugin1.so"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "wrong type",
+			config:  `[{"id":"t","file":"` + so + `","name":"Calls","type":"func() int"}]`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := g.Plan([]byte(tt.config))
+			if err != nil {
+				t.Fatalf("Plan() error = %v", err)
+			}
+			if p.OK() == tt.wantErr {
+				t.Fatalf("OK() = %v, errors: %v", p.OK(), p.Errors)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(p.Added) != len(tt.added) {
+				t.Fatalf("expect %d added items but got %d", len(tt.added), len(p.Added))
+			}
+			for _, item := range p.Added {
+				if tt.added[item.ID] != item.Name || item.Version != "3.1.0" || item.Plugin != "plugin3" {
+					t.Errorf("unexpected item %+v", item)
+				}
+			}
+		})
+	}
+}
+
+func TestGlean_ManifestFailed(t *testing.T) {
+	log.SetDummyLogger()
+
+	dir, err := ioutil.TempDir("", "glean")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	buf, err := ioutil.ReadFile("_example/test/plugins/plugin3/plugin3.so")
+	if err != nil {
+		t.Fatalf("failed to read plugin3: %v", err)
+	}
+	so := filepath.Join(dir, "plugin3.so")
+	if err = ioutil.WriteFile(so, buf, 0755); err != nil {
+		t.Fatalf("failed to write %s: %v", so, err)
+	}
+
+	// the item without a name fails, but the other items are applied.
+	file := filepath.Join(dir, "plugin.json")
+	config := `[{"file":"_example/test/plugins/plugin1/plugin1.so"},{"file":"` + so + `"},
+		{"id":"add","file":"_example/test/plugins/plugin1/plugin1.so","name":"Add"}]`
+	if err = ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", file, err)
+	}
+	g := New(file)
+	defer g.Close()
+	var failed []string
+	g.OnEvent(func(e Event) {
+		if e.Type == EventFailed {
+			failed = append(failed, e.ID)
+		}
+	})
+	if err = g.LoadConfig(); err == nil {
+		t.Errorf("expect an error for the plugin without a manifest")
+	}
+	for _, id := range []string{"add", "plugin3.threshold", "plugin3.calls"} {
+		if _, ok := g.Snapshot().Item(id); !ok {
+			t.Errorf("expect %s to be loaded", id)
+		}
+	}
+	if len(failed) != 1 || failed[0] != "_example/test/plugins/plugin1/plugin1.so" {
+		t.Errorf("unexpected failed events: %v", failed)
+	}
+
+	// items expanded from a plugin that is broken keep their current versions.
+	if err = ioutil.WriteFile(so, []byte("broken"), 0755); err != nil {
+		t.Fatalf("failed to write %s: %v", so, err)
+	}
+	if _, err = g.Refresh(context.Background()); err == nil {
+		t.Errorf("expect an error for the broken plugin")
+	}
+	for _, id := range []string{"add", "plugin3.threshold", "plugin3.calls"} {
+		if _, ok := g.Snapshot().Item(id); !ok {
+			t.Errorf("expect %s to be kept", id)
+		}
+	}
+	var found bool
+	for _, st := range g.Status() {
+		if st.ID == so && st.Error != "" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expect the broken plugin in status: %+v", g.Status())
+	}
+}
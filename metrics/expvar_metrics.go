@@ -0,0 +1,226 @@
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of histogram buckets in seconds.
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// ExpvarMetrics keeps counters and histograms in memory and publishes them by expvar.
+// They can be exposed in the Prometheus text format by PrometheusHandler too.
+type ExpvarMetrics struct {
+	mu         sync.Mutex
+	buckets    []float64
+	counters   map[string]*series
+	histograms map[string]*series
+}
+
+type series struct {
+	name   string
+	labels []string
+	value  float64
+	// counts of buckets, sum and count are only for histograms.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewExpvarMetrics returns an ExpvarMetrics that is published as the expvar of name if name is not empty.
+// Like expvar.Publish, it panics if name is already published.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	m := &ExpvarMetrics{
+		buckets:    DefaultBuckets,
+		counters:   make(map[string]*series),
+		histograms: make(map[string]*series),
+	}
+	if name != "" {
+		expvar.Publish(name, expvar.Func(m.vars))
+	}
+	return m
+}
+
+func seriesKey(name string, labels []string) string {
+	return name + "\xff" + strings.Join(labels, "\xff")
+}
+
+func (m *ExpvarMetrics) Add(name string, delta float64, labels ...string) {
+	key := seriesKey(name, labels)
+	m.mu.Lock()
+	s := m.counters[key]
+	if s == nil {
+		s = &series{name: name, labels: append([]string(nil), labels...)}
+		m.counters[key] = s
+	}
+	s.value += delta
+	m.mu.Unlock()
+}
+
+func (m *ExpvarMetrics) Observe(name string, value float64, labels ...string) {
+	key := seriesKey(name, labels)
+	m.mu.Lock()
+	s := m.histograms[key]
+	if s == nil {
+		s = &series{name: name, labels: append([]string(nil), labels...), counts: make([]uint64, len(m.buckets))}
+		m.histograms[key] = s
+	}
+	for i, le := range m.buckets {
+		if value <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+	m.mu.Unlock()
+}
+
+// Counter returns the value of the counter.
+func (m *ExpvarMetrics) Counter(name string, labels ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.counters[seriesKey(name, labels)]; s != nil {
+		return s.value
+	}
+	return 0
+}
+
+// HistogramCount returns how many values are observed by the histogram.
+func (m *ExpvarMetrics) HistogramCount(name string, labels ...string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.histograms[seriesKey(name, labels)]; s != nil {
+		return s.count
+	}
+	return 0
+}
+
+// vars returns all series for expvar, keyed by their names with labels.
+func (m *ExpvarMetrics) vars() interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counters := make(map[string]float64, len(m.counters))
+	for _, s := range m.counters {
+		counters[s.name+formatLabels(s.labels)] = s.value
+	}
+
+	type histogram struct {
+		Buckets map[string]uint64 `json:"buckets"`
+		Sum     float64           `json:"sum"`
+		Count   uint64            `json:"count"`
+	}
+	histograms := make(map[string]histogram, len(m.histograms))
+	for _, s := range m.histograms {
+		h := histogram{Buckets: make(map[string]uint64, len(m.buckets)), Sum: s.sum, Count: s.count}
+		for i, le := range m.buckets {
+			h.Buckets[formatFloat(le)] = s.counts[i]
+		}
+		histograms[s.name+formatLabels(s.labels)] = h
+	}
+
+	return map[string]interface{}{
+		"counters":   counters,
+		"histograms": histograms,
+	}
+}
+
+// WritePrometheus writes all series in the Prometheus text exposition format.
+func (m *ExpvarMetrics) WritePrometheus(w io.Writer) error {
+	m.mu.Lock()
+	counters := sortSeries(m.counters)
+	histograms := sortSeries(m.histograms)
+	var b strings.Builder
+	var last string
+	for _, s := range counters {
+		if s.name != last {
+			fmt.Fprintf(&b, "# TYPE %s counter\n", s.name)
+			last = s.name
+		}
+		fmt.Fprintf(&b, "%s%s %s\n", s.name, formatLabels(s.labels), formatFloat(s.value))
+	}
+	for _, s := range histograms {
+		if s.name != last {
+			fmt.Fprintf(&b, "# TYPE %s histogram\n", s.name)
+			last = s.name
+		}
+		for i, le := range m.buckets {
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", s.name, formatLabels(s.labels, "le", formatFloat(le)), s.counts[i])
+		}
+		fmt.Fprintf(&b, "%s_bucket%s %d\n", s.name, formatLabels(s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(&b, "%s_sum%s %s\n", s.name, formatLabels(s.labels), formatFloat(s.sum))
+		fmt.Fprintf(&b, "%s_count%s %d\n", s.name, formatLabels(s.labels), s.count)
+	}
+	m.mu.Unlock()
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// PrometheusHandler returns an http.Handler that exposes m in the Prometheus text format.
+func PrometheusHandler(m *ExpvarMetrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.WritePrometheus(w)
+	})
+}
+
+func sortSeries(m map[string]*series) []*series {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ss := make([]*series, 0, len(keys))
+	for _, k := range keys {
+		ss = append(ss, m[k])
+	}
+	return ss
+}
+
+// formatLabels formats key value pairs as {k="v",...}. A key without a value is dropped.
+func formatLabels(labels []string, extra ...string) string {
+	n := len(labels) &^ 1
+	labels = append(labels[:n:n], extra...)
+	if len(labels) < 2 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExpvarMetrics(t *testing.T) {
+	m := NewExpvarMetrics("glean_test")
+	m.Add("glean_reloads_total", 1, "id", "a", "result", "ok")
+	m.Add("glean_reloads_total", 2, "id", "a", "result", "ok")
+	m.Add("glean_reloads_total", 1, "id", `b"\`, "result", "error")
+	m.Observe("glean_reload_pass_seconds", 0.003)
+	m.Observe("glean_reload_pass_seconds", 20)
+
+	if got := m.Counter("glean_reloads_total", "id", "a", "result", "ok"); got != 3 {
+		t.Errorf("counter = %v, want 3", got)
+	}
+	if got := m.HistogramCount("glean_reload_pass_seconds"); got != 2 {
+		t.Errorf("histogram count = %v, want 2", got)
+	}
+
+	var vars struct {
+		Counters   map[string]float64 `json:"counters"`
+		Histograms map[string]struct {
+			Count uint64 `json:"count"`
+		} `json:"histograms"`
+	}
+	if err := json.Unmarshal([]byte(expvar.Get("glean_test").String()), &vars); err != nil {
+		t.Fatalf("failed to unmarshal expvar: %v", err)
+	}
+	if vars.Counters[`glean_reloads_total{id="a",result="ok"}`] != 3 || vars.Histograms["glean_reload_pass_seconds"].Count != 2 {
+		t.Errorf("unexpected expvar: %+v", vars)
+	}
+
+	w := httptest.NewRecorder()
+	PrometheusHandler(m).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE glean_reloads_total counter",
+		`glean_reloads_total{id="a",result="ok"} 3`,
+		`glean_reloads_total{id="b\"\\",result="error"} 1`,
+		"# TYPE glean_reload_pass_seconds histogram",
+		`glean_reload_pass_seconds_bucket{le="0.001"} 0`,
+		`glean_reload_pass_seconds_bucket{le="0.005"} 1`,
+		`glean_reload_pass_seconds_bucket{le="10"} 1`,
+		`glean_reload_pass_seconds_bucket{le="+Inf"} 2`,
+		"glean_reload_pass_seconds_sum 20.003",
+		"glean_reload_pass_seconds_count 2",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expect %q in:\n%s", line, body)
+		}
+	}
+}
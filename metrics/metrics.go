@@ -0,0 +1,32 @@
+package metrics
+
+var m Metrics = &dummyMetrics{}
+
+// Metrics records counters and histograms.
+// Labels are key value pairs, for example Add("glean_reloads_total", 1, "id", id).
+type Metrics interface {
+	// Add adds delta to the counter.
+	Add(name string, delta float64, labels ...string)
+	// Observe records a value, such as a latency in seconds, in the histogram.
+	Observe(name string, value float64, labels ...string)
+}
+
+func SetMetrics(metrics Metrics) {
+	m = metrics
+}
+
+func SetDummyMetrics() {
+	m = &dummyMetrics{}
+}
+
+func GetMetrics() Metrics {
+	return m
+}
+
+func Add(name string, delta float64, labels ...string) {
+	m.Add(name, delta, labels...)
+}
+
+func Observe(name string, value float64, labels ...string) {
+	m.Observe(name, value, labels...)
+}
@@ -0,0 +1,94 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/smallnest/glean/log"
+	"github.com/smallnest/glean/metrics"
+)
+
+func TestGlean_Metrics(t *testing.T) {
+	log.SetDummyLogger()
+	m := metrics.NewExpvarMetrics("")
+	metrics.SetMetrics(m)
+	defer metrics.SetDummyMetrics()
+
+	file := copyConfig(t, "plugin_test.json")
+	defer os.RemoveAll(filepath.Dir(file))
+
+	g := New(file)
+	defer g.Close()
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	id := "EF5A35EC-46EB-4E62-8251-78F1A49FA7DC"
+	g.UpdateItem(PluginItem{ID: id, File: "_example/test/plugins/pluginabc/plugin1.so", Name: "Add"})
+	g.UpdateItem(PluginItem{ID: id, File: "_example/test/plugins/plugin1/plugin1.so", Name: "Add", Version: "1.1"})
+	g.Rollback(id, "1.0")
+	g.Rollback(id, "0.1")
+
+	tests := []struct {
+		name   string
+		labels []string
+		want   float64
+	}{
+		{name: "glean_reloads_total", labels: []string{"id", id, "result", "ok"}, want: 3},
+		{name: "glean_reloads_total", labels: []string{"id", id, "result", "error"}, want: 1},
+		{name: "glean_rollbacks_total", labels: []string{"id", id, "result", "ok"}, want: 1},
+		{name: "glean_rollbacks_total", labels: []string{"id", id, "result", "error"}, want: 1},
+	}
+	for _, tt := range tests {
+		if got := m.Counter(tt.name, tt.labels...); got != tt.want {
+			t.Errorf("%s%v = %v, want %v", tt.name, tt.labels, got, tt.want)
+		}
+	}
+	if m.Counter("glean_plugin_opens_total", "result", "error") == 0 {
+		t.Errorf("expect the missing plugin to be counted")
+	}
+	if m.HistogramCount("glean_reload_pass_seconds") != 4 || m.HistogramCount("glean_plugin_open_seconds") == 0 {
+		t.Errorf("expect latencies to be observed")
+	}
+}
+
+func TestCountReloads(t *testing.T) {
+	m := metrics.NewExpvarMetrics("")
+	metrics.SetMetrics(m)
+	defer metrics.SetDummyMetrics()
+
+	err := errors.New("failed")
+	countReloads([]Event{
+		{Type: EventChanged, ID: "a"},
+		{Type: EventFailed, ID: "a", Err: err},
+		{Type: EventFailed, ID: "b", Err: err},
+		{Type: EventRemoved, ID: "b", Err: err},
+		{Type: EventAdded, ID: "c"},
+		{Type: EventReloaded, ID: "c"},
+		{Type: EventRemoved, ID: "d"},
+		{Type: EventApplied},
+	})
+
+	tests := []struct {
+		id     string
+		ok     float64
+		failed float64
+	}{
+		{"a", 0, 1},
+		{"b", 0, 1},
+		{"c", 1, 0},
+		{"d", 0, 0},
+	}
+	for _, tt := range tests {
+		ok, failed := m.Counter("glean_reloads_total", "id", tt.id, "result", "ok"), m.Counter("glean_reloads_total", "id", tt.id, "result", "error")
+		if ok != tt.ok || failed != tt.failed {
+			t.Errorf("expect %s to be counted as %v ok and %v error but got %v and %v", tt.id, tt.ok, tt.failed, ok, failed)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"encoding/json"
+	"reflect"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// Plan is what Glean would do with a config.
+type Plan struct {
+	ChangeSet
+	// Bindings are the checks of watched functions and variables against the symbols of the config.
+	Bindings []*BindingCheck
+	// Errors are validation errors of the config, errors of opening added or changed items and unsatisfied requirements.
+	Errors []error
+}
+
+// OK reports whether the config can be applied without any error.
+func (p *Plan) OK() bool {
+	if len(p.Errors) > 0 {
+		return false
+	}
+	for _, b := range p.Bindings {
+		if b.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// BindingCheck is the type and version compatibility of a watched function or variable and the symbol it would be reloaded from.
+type BindingCheck struct {
+	ID string
+	// Want is the type of the watched function or variable.
+	Want reflect.Type
+	// Got is the type of the symbol. It is nil if the symbol can't be looked up.
+	Got reflect.Type
+	Err error
+}
+
+// Plan returns what Glean would do with the given config without applying it,
+// including dependents that would be restarted or stopped with the items they require.
+// Added and changed plugins are opened to check their symbols,
+// which can't be undone because the Go runtime never unloads plugins, but nothing is swapped into Glean.
+// The returned error is only for a config that can't be parsed.
+func (g *Glean) Plan(config []byte) (*Plan, error) {
+	items, err := g.parseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Plan{}
+	g.mu.RLock()
+	current := g.pluginItems
+	g.mu.RUnlock()
+	items, _, failed, err := g.resolveItems(items, current)
+	if err != nil {
+		if merr, ok := err.(*multierror.Error); ok {
+			p.Errors = append(p.Errors, merr.Errors...)
+		} else {
+			p.Errors = append(p.Errors, err)
+		}
+		return p, nil
+	}
+	for _, f := range failed {
+		p.Errors = append(p.Errors, f.err)
+	}
+
+	g.mu.RLock()
+	available := make(map[string]*PluginItem, len(g.idMap))
+	for id, item := range g.idMap {
+		available[id] = item
+	}
+	bound := make(map[string]interface{})
+	bindings := make(map[string]*binding)
+	for id := range g.watched {
+		if item := g.idMap[id]; item != nil && item.v != nil {
+			bound[id] = item.v
+			bindings[id] = g.bindings[id]
+		}
+	}
+	g.mu.RUnlock()
+
+	p.ChangeSet = diffPlugins(current, items)
+	cascadeChanges(&p.ChangeSet, current, items)
+
+	// check requirements like applyLocked does, in the order of items.
+	for _, item := range p.Removed {
+		delete(available, item.ID)
+	}
+	touched := make(map[string]bool, len(p.Added)+len(p.Changed))
+	for _, item := range p.Added {
+		touched[item.ID] = true
+	}
+	for _, c := range p.Changed {
+		touched[c.New.ID] = true
+	}
+	for _, item := range items {
+		if !touched[item.ID] {
+			continue
+		}
+		if err := checkRequires(item, available); err != nil {
+			p.Errors = append(p.Errors, err)
+			delete(available, item.ID)
+		} else {
+			available[item.ID] = item
+		}
+	}
+
+	check := func(item *PluginItem) {
+		_, s, err := lookupItem(item, nil, nil)
+		if err != nil {
+			p.Errors = append(p.Errors, err)
+		}
+
+		vPtr, ok := bound[item.ID]
+		if !ok {
+			return
+		}
+		b := &BindingCheck{ID: item.ID, Want: reflect.TypeOf(vPtr).Elem(), Err: err}
+		if err == nil {
+			b.Got = symbolValue(s).Type()
+			b.Err = checkSymbol(s, vPtr)
+		}
+		if b.Err == nil {
+			b.Err = bindings[item.ID].checkVersion(item)
+		}
+		p.Bindings = append(p.Bindings, b)
+	}
+
+	for _, item := range p.Added {
+		check(item)
+	}
+	for _, c := range p.Changed {
+		check(c.New)
+	}
+	for _, item := range p.Removed {
+		if vPtr, ok := bound[item.ID]; ok {
+			p.Bindings = append(p.Bindings, &BindingCheck{ID: item.ID, Want: reflect.TypeOf(vPtr).Elem(), Err: ErrItemHasNotConfigured})
+		}
+	}
+
+	return p, nil
+}
+
+// MarshalJSON encodes the plan with ids of items, names of types and messages of errors.
+func (p *Plan) MarshalJSON() ([]byte, error) {
+	type change struct {
+		ID     string   `json:"id"`
+		Fields []string `json:"fields"`
+	}
+	type binding struct {
+		ID    string `json:"id"`
+		Want  string `json:"want"`
+		Got   string `json:"got,omitempty"`
+		Error string `json:"error,omitempty"`
+	}
+	v := struct {
+		OK       bool      `json:"ok"`
+		Added    []string  `json:"added,omitempty"`
+		Changed  []change  `json:"changed,omitempty"`
+		Removed  []string  `json:"removed,omitempty"`
+		Bindings []binding `json:"bindings,omitempty"`
+		Errors   []string  `json:"errors,omitempty"`
+	}{OK: p.OK()}
+
+	for _, item := range p.Added {
+		v.Added = append(v.Added, item.ID)
+	}
+	for _, c := range p.Changed {
+		v.Changed = append(v.Changed, change{ID: c.New.ID, Fields: c.Fields})
+	}
+	for _, item := range p.Removed {
+		v.Removed = append(v.Removed, item.ID)
+	}
+	typeName := func(t reflect.Type) string {
+		if t == nil {
+			return ""
+		}
+		return t.String()
+	}
+	for _, b := range p.Bindings {
+		bc := binding{ID: b.ID, Want: typeName(b.Want), Got: typeName(b.Got)}
+		if b.Err != nil {
+			bc.Error = b.Err.Error()
+		}
+		v.Bindings = append(v.Bindings, bc)
+	}
+	for _, err := range p.Errors {
+		v.Errors = append(v.Errors, err.Error())
+	}
+
+	return json.Marshal(v)
+}
@@ -0,0 +1,102 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"testing"
+
+	"github.com/smallnest/glean/log"
+)
+
+func TestGlean_Plan(t *testing.T) {
+	log.SetDummyLogger()
+
+	g := New("plugin_test.json")
+	defer g.Close()
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	var fn func(x, y int) int
+	if err := g.ReloadAndWatch("EF5A35EC-46EB-4E62-8251-78F1A49FA7DC", &fn); err != nil {
+		t.Fatalf("failed to reload fn: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		config   string
+		wantErr  bool
+		ok       bool
+		added    int
+		changed  int
+		removed  int
+		bindings int
+	}{
+		{
+			name:    "invalid json",
+			config:  `[{]`,
+			wantErr: true,
+		},
+		{
+			name:   "duplicated",
+			config: `[{"id":"a","file":"a.so","name":"A"},{"id":"a","file":"a.so","name":"A"}]`,
+		},
+		{
+			name: "compatible",
+			config: `[
+				{"id":"EF5A35EC-46EB-4E62-8251-78F1A49FA7DC","file":"_example/test/plugins/plugin1/plugin1.so","name":"Add","version":"1.0"},
+				{"id":"2E8FD057-99EC-41B9-8172-0EBF18F9A48D","file":"_example/test/plugins/plugin2/plugin2.so","name":"V","version":"1.0"},
+				{"id":"new","file":"_example/test/plugins/plugin1/plugin1.so","name":"V","version":"1.0"}
+			]`,
+			ok:       true,
+			added:    1,
+			changed:  1,
+			bindings: 1,
+		},
+		{
+			name: "missing requirement",
+			config: `[
+				{"id":"EF5A35EC-46EB-4E62-8251-78F1A49FA7DC","file":"_example/test/plugins/plugin2/plugin2.so","name":"Add","version":"1.0"},
+				{"id":"2E8FD057-99EC-41B9-8172-0EBF18F9A48D","file":"_example/test/plugins/plugin2/plugin2.so","name":"V","version":"1.0"},
+				{"id":"new","file":"_example/test/plugins/plugin1/plugin1.so","name":"V","version":"1.0","requires":["missing-id"]}
+			]`,
+			added: 1,
+		},
+		{
+			name: "incompatible",
+			config: `[
+				{"id":"EF5A35EC-46EB-4E62-8251-78F1A49FA7DC","file":"_example/test/plugins/plugin1/plugin1.so","name":"V","version":"1.0"}
+			]`,
+			changed:  1,
+			removed:  1,
+			bindings: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := g.Plan([]byte(tt.config))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Plan() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if p.OK() != tt.ok {
+				t.Errorf("OK() = %v, want %v. errors: %v", p.OK(), tt.ok, p.Errors)
+			}
+			if len(p.Added) != tt.added || len(p.Changed) != tt.changed || len(p.Removed) != tt.removed {
+				t.Errorf("got %d added, %d changed, %d removed", len(p.Added), len(p.Changed), len(p.Removed))
+			}
+			if len(p.Bindings) != tt.bindings {
+				t.Errorf("got %d bindings, want %d", len(p.Bindings), tt.bindings)
+			}
+		})
+	}
+
+	if got := fn(1, 2); got != 30 {
+		t.Errorf("Plan must not reload fn but got %d", got)
+	}
+}
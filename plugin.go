@@ -5,15 +5,22 @@
 package glean
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"plugin"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/smallnest/glean/log"
+	"github.com/smallnest/glean/metrics"
 	fsnotify "gopkg.in/fsnotify.v1"
 )
 
@@ -26,9 +33,20 @@ var (
 	ErrValueCanNotSet = errors.New("the object can't be addressable and can not be set")
 	// ErrMustBePointer the object (function or variable) must be pointer.
 	ErrMustBePointer = errors.New("the function or variable must be pointer")
+	// ErrItemExists an item with the same ID has been configured.
+	ErrItemExists = errors.New("pluginItem with the same id exists")
+	// ErrNoConfigFile glean is created from a directory and has no config file.
+	ErrNoConfigFile = errors.New("glean has no config file")
+	// ErrConfigNotPersistable the config uses profiles or ${VAR}, which would be lost if items were written back.
+	ErrConfigNotPersistable = errors.New("the config uses profiles or ${VAR} and can't be persisted")
+	// ErrNoCanary the item has no canary to promote or abort.
+	ErrNoCanary = errors.New("the item has no canary")
+	// ErrItemDisabled is returned by a function bound to an item that is disabled or otherwise skipped.
+	ErrItemDisabled = errors.New("the item is disabled")
 )
 
 // PluginItem is a configured item that can be reloaded.
+// An item that has a file but no id and name stands for all symbols listed in the manifest of the plugin.
 type PluginItem struct {
 	// File file path of this plugin.
 	File string `json:"file"`
@@ -38,78 +56,207 @@ type PluginItem struct {
 	Name string `json:"name"`
 	// Version is version of the plugin for tracing and upgrade.
 	Version string `json:"version"`
+	// Params are settings delivered to the Configure function exported by the plugin.
+	Params json.RawMessage `json:"params,omitempty"`
+	// Description describes the symbol. It may come from the manifest of the plugin.
+	Description string `json:"description,omitempty"`
+	// Type is the expected type of the symbol, such as "func(int, int) int". It may come from the manifest of the plugin.
+	Type string `json:"type,omitempty"`
+	// Requires are items that must be loaded before this item. Each of them is an item ID or a plugin name
+	// in manifests, optionally followed by a version constraint, such as "plugin3 >=3.0, <4".
+	Requires []string `json:"requires,omitempty"`
+	// Enabled is true if it is absent. A disabled item is stopped and unbound as if it were removed, but stays in the config.
+	// A function watched on it returns zero values, and ErrItemDisabled if its last result is an error,
+	// until the item is enabled and the function is bound again. A watched variable keeps the last value.
+	Enabled *bool `json:"enabled,omitempty"`
+	// GOOS limits the item to these operating systems, such as ["linux"].
+	GOOS []string `json:"goos,omitempty"`
+	// GOARCH limits the item to these architectures, such as ["amd64", "arm64"].
+	GOARCH []string `json:"goarch,omitempty"`
+	// Profiles limits the item to processes that run with one of these profiles. See WithProfile.
+	Profiles []string `json:"profiles,omitempty"`
+	// Labels limits the item to processes that have all these labels. See WithLabels.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Canary routes a percentage of calls to another version of the plugin. See CanaryConfig.
+	Canary *CanaryConfig `json:"canary,omitempty"`
+	// Plugin is the name of the plugin in its manifest.
+	Plugin string `json:"-"`
+	// Hash is the sha256 of the plugin file when it is opened.
+	Hash string `json:"-"`
+	// Generation is the generation of Glean when this item is swapped in.
+	Generation uint64 `json:"-"`
 	// Cached points the opened plugin.
 	Cached *plugin.Plugin `json:"-"`
 	// v is the function or variable that can be reloaded.
 	v interface{}
+	// fromManifest are the fields that are taken from the manifest of the plugin, which are not persisted.
+	fromManifest []string
+	// expandedFrom is the configured item without a name that this item is expanded from by the manifest.
+	expandedFrom *PluginItem
 }
 
 // Glean is a manager that manages all configured plugins and reloaded objects.
 type Glean struct {
 	configFile  string
+	dir         string
+	persist     bool
+	atomic      bool
+	timeout     time.Duration
+	profile     string
+	labels      map[string]string
+	stateDir    string
+	copyPlugins bool
+	fallback    bool // items are loaded from the last known good config.
+	historySize int
+	sighup      bool
+	history     map[string][]HistoryEntry
+	generation  uint64
 	pluginItems []*PluginItem
+	// configured are the items of the last apply that apply to this process, including those that failed.
+	configured  []*PluginItem
+	skipped     []*PluginItem
 	idMap       map[string]*PluginItem
 	watched     map[string]bool
+	bindings    map[string]*binding
+	failures    map[string]*failure
+	quarantined map[string]*QuarantineError
+	pendingMu   sync.Mutex
+	pending     map[string]snapshotItem
+	plugins     map[*plugin.Plugin]string
+	handlers    []func(Event)
+	snapshot    atomic.Value
 	mu          sync.RWMutex
-	done        chan bool
-	closed      bool
+	// wg tracks goroutines that watch changes until Glean is closed, so Close can wait for them.
+	wg     sync.WaitGroup
+	done   chan bool
+	closed bool
+}
+
+// Option configures a Glean.
+type Option func(*Glean)
+
+// WithPersist makes AddItem, UpdateItem and RemoveItem write the resulting items back to the config file.
+// The file is replaced atomically by an array of items as they are configured, without fields that come from
+// manifests. A config that uses profiles or ${VAR} can't be written back, so modifying its items fails
+// with ErrConfigNotPersistable.
+func WithPersist() Option {
+	return func(g *Glean) {
+		g.persist = true
+	}
+}
+
+// WithAtomicReload makes every apply of changes all-or-nothing.
+// All added and changed items are opened, looked up and type-checked first,
+// and only if all of them succeed are they swapped together under one generation.
+func WithAtomicReload() Option {
+	return func(g *Glean) {
+		g.atomic = true
+	}
+}
+
+// WithLifecycleTimeout sets the timeout of every GleanInit, GleanStart, GleanStop and Configure call. The default is 10 seconds.
+func WithLifecycleTimeout(d time.Duration) Option {
+	return func(g *Glean) {
+		g.timeout = d
+	}
 }
 
 // New returns a new Glean.
-func New(configFile string) *Glean {
-	return &Glean{
-		configFile: configFile,
-		watched:    make(map[string]bool),
-		idMap:      make(map[string]*PluginItem),
-		done:       make(chan bool),
+func New(configFile string, opts ...Option) *Glean {
+	g := &Glean{
+		configFile:  configFile,
+		watched:     make(map[string]bool),
+		bindings:    make(map[string]*binding),
+		idMap:       make(map[string]*PluginItem),
+		failures:    make(map[string]*failure),
+		quarantined: make(map[string]*QuarantineError),
+		plugins:     make(map[*plugin.Plugin]string),
+		history:     make(map[string][]HistoryEntry),
+		historySize: defaultHistorySize,
+		timeout:     10 * time.Second,
+		profile:     os.Getenv(ProfileEnv),
+		done:        make(chan bool),
+	}
+
+	g.snapshot.Store(&Snapshot{})
+
+	for _, opt := range opts {
+		opt(g)
 	}
+
+	return g
 }
 
-// Close closes Glean and stop watching.
+// Close closes Glean and stop watching. It waits for the watching goroutines to exit,
+// so it must not be called by event handlers.
 func (g *Glean) Close() {
 	g.mu.Lock()
 	if !g.closed {
 		g.closed = true
 		close(g.done)
 		g.pluginItems = []*PluginItem{}
+		g.configured = nil
+		g.skipped = nil
 		g.idMap = nil
 		g.watched = nil
+		g.bindings = nil
+		g.stopUnusedPluginsLocked()
 	}
 	g.mu.Unlock()
+	g.wg.Wait()
 }
 
-// LoadConfig loads plugins from the configured file.
+// LoadConfig loads plugins from the configured file, or from the plugin directory if Glean is created by NewFromDir.
+// Items that fail to load are skipped and their errors are returned together,
+// unless Glean is created WithLastKnownGood and falls back to the last known good config.
 func (g *Glean) LoadConfig() (err error) {
-	buf, err := ioutil.ReadFile(g.configFile)
-	if err != nil {
-		log.Errorf("failed to load %s: %v", g.configFile, err)
+	items, err := g.readConfig()
+	if err != nil && g.stateDir == "" {
 		return err
 	}
 
 	g.mu.Lock()
-	defer g.mu.Unlock()
+	var events []Event
+	if err == nil {
+		events, err = g.applyLocked(items)
+		g.releaseQuarantineLocked()
+	}
+	if err != nil && g.stateDir != "" {
+		var fallback []Event
+		fallback, err = g.fallbackLocked(err)
+		events = append(events, fallback...)
+	}
+	g.mu.Unlock()
+	g.emit(events...)
 
-	err = json.Unmarshal(buf, &(g.pluginItems))
-	if err != nil {
-		log.Errorf("failed to unmarshal %s: %v", g.configFile, err)
-		return err
+	// watch changes
+	if e := g.startWatch(); e != nil {
+		err = multierror.Append(err, e)
+	} else if g.sighup {
+		g.watchSIGHUP()
 	}
+	return err
+}
 
-	// initial plugin
-	for _, item := range g.pluginItems {
-		pp, err := plugin.Open(item.File)
-		if err != nil {
-			log.Errorf("failed to load %s: %v", item.Name, err)
-			return err
-		}
+func (g *Glean) readConfig() ([]*PluginItem, error) {
+	if g.dir != "" {
+		return scanDir(g.dir)
+	}
 
-		item.Cached = pp
-		g.idMap[item.ID] = item
+	buf, err := ioutil.ReadFile(g.configFile)
+	if err != nil {
+		log.Errorf("failed to load %s: %v", g.configFile, err)
+		return nil, err
 	}
 
-	// watch changes
-	err = g.startWatch()
-	return
+	items, err := g.parseConfig(buf)
+	if err != nil {
+		log.Errorf("failed to unmarshal %s: %v", g.configFile, err)
+		metrics.Add("glean_config_errors_total", 1)
+		return nil, err
+	}
+
+	return items, nil
 }
 
 // start to watch changes of config changes
@@ -120,29 +267,69 @@ func (g *Glean) startWatch() error {
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Fatal(err)
+		log.Errorf("failed to create a watcher: %v", err)
 		return err
 	}
 
-	err = watcher.Add(g.configFile)
+	// watch the directory because editors and persistItems replace the file by renaming,
+	// which would silently drop a watch on the file itself.
+	configFile := filepath.Clean(g.configFile)
+	watchDir := filepath.Dir(configFile)
+	match := func(name string) bool { return filepath.Clean(name) == configFile }
+	ops := fsnotify.Write | fsnotify.Create
+	var delay time.Duration
+	if g.dir != "" {
+		watchDir, match = g.dir, isDirFile
+		ops |= fsnotify.Remove | fsnotify.Rename
+		delay = dirSettleDelay
+	}
+
+	err = watcher.Add(watchDir)
 	if err != nil {
 		watcher.Close()
-		log.Fatal(err)
+		log.Errorf("failed to watch %s: %v", watchDir, err)
+		return err
 	}
 
+	g.wg.Add(1)
 	go func() {
+		defer g.wg.Done()
+		// changes of the plugin directory are checked in this goroutine once they settle.
+		var timer *time.Timer
+		var settled <-chan time.Time
 	watch:
 		for {
 			select {
 			case event := <-watcher.Events:
+				if !match(event.Name) {
+					continue
+				}
 				log.Info("watch event:", event)
-				if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Rename == fsnotify.Rename {
-					log.Infof("config file %s is modified", event.Name)
+				if event.Op&ops == 0 {
+					continue
+				}
+				log.Infof("%s is modified", event.Name)
+				if delay == 0 {
 					g.checkChanges() // the config file has been modified
+				} else if timer == nil {
+					timer = time.NewTimer(delay)
+				} else {
+					timer.Reset(delay)
+				}
+				if timer != nil {
+					settled = timer.C
 				}
+			case <-settled:
+				settled = nil
+				g.checkChanges()
 			case err := <-watcher.Errors:
 				log.Errorf("watcher error: %v", err)
+				metrics.Add("glean_watch_errors_total", 1)
 			case <-g.done:
+				if timer != nil {
+					timer.Stop()
+				}
+				watcher.Close()
 				break watch
 			}
 		}
@@ -151,108 +338,418 @@ func (g *Glean) startWatch() error {
 	return err
 }
 
-func (g *Glean) checkChanges() {
-	buf, err := ioutil.ReadFile(g.configFile)
-	if err != nil {
-		log.Errorf("failed to load %s: %v", g.configFile, err)
-		return
-	}
+func (g *Glean) checkChanges() error {
+	_, err := g.Refresh(context.Background())
+	return err
+}
 
-	var latestPluginItems []*PluginItem
+// applyLocked replaces the current items with latestPluginItems.
+// Every added or changed item is opened and validated before it is swapped in,
+// so an item that fails keeps its previous version (or stays absent) and is retried by the next apply.
+// Items that depend on changed items restart their plugins, and items whose requirements can't be satisfied are stopped.
+// In atomic mode nothing is swapped if any item fails.
+// Items that don't apply to this process, such as disabled items, are handled as removed.
+// g.mu must be held.
+func (g *Glean) applyLocked(latestPluginItems []*PluginItem) (events []Event, err error) {
+	start := time.Now()
+	defer func() {
+		metrics.Observe("glean_reload_pass_seconds", time.Since(start).Seconds())
+		countReloads(events)
+	}()
 
-	err = json.Unmarshal(buf, &(latestPluginItems))
+	latestPluginItems, skipped, failed, err := g.resolveItems(latestPluginItems, g.pluginItems)
 	if err != nil {
-		log.Errorf("failed to unmarshal %s: %v", g.configFile, err)
-		return
+		log.Errorf("invalid plugin items: %v", err)
+		metrics.Add("glean_config_errors_total", 1)
+		return nil, err
+	}
+	g.configured = latestPluginItems
+
+	cs := diffPlugins(g.pluginItems, latestPluginItems)
+	cascadeChanges(&cs, g.pluginItems, latestPluginItems)
+	g.pruneFailuresLocked(latestPluginItems, &cs)
+	// items without names whose manifests can't be read are reported by their files, and retried by the next apply.
+	for _, f := range failed {
+		log.Errorf("failed to expand %s: %v", f.item.File, f.err)
+		g.configured = append(g.configured, f.item)
+		g.failures[f.item.File] = f
+		err = multierror.Append(err, f.err)
+		events = append(events, Event{Type: EventFailed, ID: f.item.File, Item: f.item, Err: f.err})
+	}
+	if cs.Empty() {
+		g.skipped = skipped
+		if len(g.failures) == 0 {
+			g.fallback = false
+		}
+		return events, err
 	}
+	defer g.clearPending()
 
-	g.mu.Lock()
-	defer g.mu.Unlock()
+	// items that will be active if everything goes well, to check requirements.
+	available := make(map[string]*PluginItem, len(g.idMap))
+	for id, item := range g.idMap {
+		available[id] = item
+	}
+	for _, item := range cs.Removed {
+		delete(available, item.ID)
+	}
 
-	currentPluginItems := g.pluginItems
-	added, changed, removed := diffPlugins(currentPluginItems, latestPluginItems)
-	g.pluginItems = latestPluginItems
+	changes := make(map[string]*ItemChange, len(cs.Changed))
+	for _, c := range cs.Changed {
+		changes[c.New.ID] = c
+	}
+	added := make(map[string]bool, len(cs.Added))
+	for _, item := range cs.Added {
+		added[item.ID] = true
+	}
+	started := make(map[*plugin.Plugin]bool, len(g.plugins))
+	for pp := range g.plugins {
+		started[pp] = true
+	}
 
-	for _, item := range removed {
-		delete(g.idMap, item.ID)
-		delete(g.watched, item.ID)
+	// prepare: open, look up and type-check all added and changed items before swapping any of them.
+	// latestPluginItems are sorted, so items are prepared after the items they require.
+	var prepared []*preparedItem
+	for _, item := range latestPluginItems {
+		change := changes[item.ID]
+		if change == nil && !added[item.ID] {
+			continue
+		}
+		if change != nil {
+			item.v = change.Old.v
+		} else if b := g.bindings[item.ID]; b != nil && g.watched[item.ID] {
+			// the item is watched before it is added, or it is enabled again.
+			item.v = b.v
+		}
+
+		p := &preparedItem{item: item, change: change}
+		if p.err = checkRequires(item, available); p.err != nil {
+			// an active item that loses its dependency is stopped.
+			p.deactivate = change != nil
+			delete(available, item.ID)
+		} else if p = g.prepareItemLocked(item, change); p.err == nil {
+			available[item.ID] = item
+			g.setPending(item, p.sym)
+		}
+		prepared = append(prepared, p)
 	}
 
-	// update changed
-	for _, item := range changed {
-		pp, e := plugin.Open(item.File)
-		if e != nil {
-			log.Errorf("failed to load %s: %v", item.Name, e)
-			err = multierror.Append(err, e)
+	for _, p := range prepared {
+		if p.err != nil {
+			g.failures[p.item.ID] = &failure{item: p.item, err: p.err}
+			err = multierror.Append(err, p.err)
+			events = append(events, Event{Type: EventFailed, ID: p.item.ID, Item: p.item, Change: p.change, Err: p.err})
 		}
-		item.Cached = pp
-		item.v = g.idMap[item.ID].v
-		g.idMap[item.ID] = item
+	}
+	if err == nil && g.atomic {
+		// params are delivered to serving plugins only when all items are prepared, and taken back if any fails.
+		var configured []*preparedItem
+		for _, p := range prepared {
+			if e := g.reconfigure(p); e != nil {
+				for _, c := range configured {
+					g.restoreParams(c, len(c.reconfigure))
+				}
+				g.failures[p.item.ID] = &failure{item: p.item, err: e}
+				err = multierror.Append(err, e)
+				events = append(events, Event{Type: EventFailed, ID: p.item.ID, Item: p.item, Change: p.change, Err: e})
+				break
+			}
+			configured = append(configured, p)
+		}
+	}
+	if err != nil && g.atomic {
+		log.Errorf("none of the changes is applied because some items failed: %v", err)
+		g.stopUnusedPluginsLocked()
+		return events, err
 	}
 
-	// add added
-	for _, item := range added {
-		pp, e := plugin.Open(item.File)
-		if e != nil {
-			log.Errorf("failed to load %s: %v", item.Name, e)
-			err = multierror.Append(err, e)
+	// commit: swap all prepared items under one generation.
+	if len(cs.Removed) > 0 || len(prepared) > len(events) {
+		g.generation++
+	}
+	skippedIDs := make(map[string]bool, len(skipped))
+	for _, item := range skipped {
+		skippedIDs[item.ID] = true
+	}
+	for _, item := range cs.Removed {
+		delete(g.idMap, item.ID)
+		if skippedIDs[item.ID] {
+			// a skipped item, such as a disabled one, keeps its watch so it is bound again when it applies again.
+			g.unbindLocked(item.ID)
+		} else {
+			delete(g.watched, item.ID)
+			delete(g.bindings, item.ID)
 		}
-		item.Cached = pp
-		g.idMap[item.ID] = item
+		events = append(events, Event{Type: EventRemoved, ID: item.ID, Item: item})
 	}
 
-	//reload all variables
-	for _, item := range changed {
-		watchID := g.watched[item.ID]
+	restarted := make(map[*plugin.Plugin]bool)
+	for _, p := range prepared {
+		if p.err != nil {
+			if p.deactivate {
+				delete(g.idMap, p.item.ID)
+				events = append(events, Event{Type: EventRemoved, ID: p.item.ID, Item: p.change.Old, Change: p.change, Err: p.err})
+			}
+			continue
+		}
+
+		item := p.item
+		if !g.atomic {
+			if e := g.reconfigure(p); e != nil {
+				g.failures[item.ID] = &failure{item: item, err: e}
+				err = multierror.Append(err, e)
+				events = append(events, Event{Type: EventFailed, ID: item.ID, Item: item, Change: p.change, Err: e})
+				continue
+			}
+		}
+		if p.change != nil && p.change.Has(FieldDependency) && started[item.Cached] && !restarted[item.Cached] {
+			// restart the plugin so that it sees the new versions of its dependencies.
+			restarted[item.Cached] = true
+			if e := g.restartPluginLocked(item); e != nil {
+				g.failures[item.ID] = &failure{item: item, err: e}
+				delete(g.idMap, item.ID)
+				err = multierror.Append(err, e)
+				events = append(events, Event{Type: EventFailed, ID: item.ID, Item: item, Change: p.change, Err: e},
+					Event{Type: EventRemoved, ID: item.ID, Item: p.change.Old, Change: p.change, Err: e})
+				continue
+			}
+		}
 
-		if watchID {
-			e := ReloadFromPlugin(item.Cached, item.Name, item.v)
+		item.Generation = g.generation
+		g.idMap[item.ID] = item
+		delete(g.failures, item.ID)
+		if p.change == nil {
+			events = append(events, Event{Type: EventAdded, ID: item.ID, Item: item})
+		} else {
+			log.Infof("%s is changed: %s", item.ID, p.change.Reason())
+			events = append(events, Event{Type: EventChanged, ID: item.ID, Item: item, Change: p.change})
+		}
+
+		if g.watched[item.ID] && item.v != nil {
+			e := assignSymbol(g.wrap(g.bindings[item.ID], item, p.sym), item.v)
 			if e != nil {
-				log.Errorf("failed to reload %s, %s from %s: %v", item.ID, item.Name, item.File, err)
+				log.Errorf("failed to reload %s, %s from %s: %v", item.ID, item.Name, item.File, e)
 				err = multierror.Append(err, e)
+				events = append(events, Event{Type: EventFailed, ID: item.ID, Item: item, Change: p.change, Err: e})
 			} else {
 				log.Infof("succeeded to reload %s, %s from %s", item.ID, item.Name, item.File)
+				events = append(events, Event{Type: EventReloaded, ID: item.ID, Item: item, Change: p.change})
 			}
 		}
 	}
-}
 
-func diffPlugins(currentPluginItems, latestPluginItems []*PluginItem) (added, changed, removed []*PluginItem) {
-	latestM := make(map[string]*PluginItem)
+	// keep the order of latestPluginItems but only with items that are active.
+	items := make([]*PluginItem, 0, len(latestPluginItems))
 	for _, item := range latestPluginItems {
-		latestM[item.ID] = item
+		if active, ok := g.idMap[item.ID]; ok {
+			items = append(items, active)
+		}
+	}
+	g.pluginItems = items
+	g.skipped = skipped
+	g.takeSnapshotLocked()
+	g.stopUnusedPluginsLocked()
+	if err == nil && len(g.failures) == 0 {
+		g.fallback = false
+		g.saveLastKnownGoodLocked()
 	}
 
-	currentM := make(map[string]*PluginItem)
-	for _, item := range currentPluginItems {
-		currentM[item.ID] = item
+	g.recordHistoryLocked(events)
+	events = append(events, Event{Type: EventApplied, Changes: &cs})
+	return events, err
+}
+
+// countReloads counts the outcome of every item reloaded by an apply once, as glean_reloads_total.
+// An item that is swapped in and then fails, such as failing to be bound, is counted as an error.
+func countReloads(events []Event) {
+	var ids []string
+	results := make(map[string]string)
+	for _, e := range events {
+		var result string
+		switch {
+		case e.Type == EventAdded || e.Type == EventChanged:
+			result = "ok"
+		case e.Type == EventFailed || e.Type == EventRemoved && e.Err != nil:
+			result = "error"
+		default:
+			continue
+		}
+		if _, ok := results[e.ID]; !ok {
+			ids = append(ids, e.ID)
+		}
+		results[e.ID] = result
+	}
+	for _, id := range ids {
+		metrics.Add("glean_reloads_total", 1, "id", id, "result", results[id])
 	}
+}
 
-	for _, item := range latestPluginItems {
-		if i, exist := currentM[item.ID]; exist {
-			if item.File != i.File {
-				changed = append(changed, item)
-			}
-		} else {
-			added = append(added, item)
+// preparedItem is an added or changed item that has been opened but not swapped in.
+type preparedItem struct {
+	item   *PluginItem
+	change *ItemChange
+	sym    plugin.Symbol
+	err    error
+	// deactivate is set if the active version must be stopped because the item can't be satisfied.
+	deactivate bool
+	// reconfigure are the item or its canary whose plugins serve the old version but have new params.
+	// Their Configure is called when the item is swapped in.
+	reconfigure []*PluginItem
+}
+
+// prepareItemLocked opens and configures item and starts its plugin if it is the first item of the plugin.
+// g.mu must be held.
+func (g *Glean) prepareItemLocked(item *PluginItem, change *ItemChange) *preparedItem {
+	p := &preparedItem{item: item, change: change}
+	if p.err = g.checkQuarantineLocked(item); p.err != nil {
+		log.Errorf("refuse to load %s: %v", item.ID, p.err)
+		return p
+	}
+	if p.err = g.bindings[item.ID].checkVersion(item); p.err != nil {
+		log.Errorf("refuse to load %s: %v", item.ID, p.err)
+		return p
+	}
+
+	// the binary is not changed, so only look up the symbol again.
+	var pp *plugin.Plugin
+	reopen := change == nil || change.Has(FieldFile) || change.Has(FieldHash)
+	if !reopen {
+		pp = change.Old.Cached
+	}
+
+	pp, p.sym, p.err = lookupItem(item, pp, item.v)
+	if p.err != nil {
+		return p
+	}
+	item.Cached = pp
+
+	if reopen {
+		if p.err = g.configureItem(item); p.err != nil {
+			return p
+		}
+	} else if change.Has(FieldParams) {
+		p.reconfigure = append(p.reconfigure, item)
+	}
+
+	if p.err = g.startPluginLocked(item); p.err != nil {
+		return p
+	}
+	if item.Canary != nil {
+		p.err = g.prepareCanaryLocked(p)
+	}
+	return p
+}
+
+// reconfigure delivers the new params of p to plugins that serve the old version of the item.
+// If any of them fails, the old params are delivered again to those that have been configured.
+func (g *Glean) reconfigure(p *preparedItem) error {
+	for i, item := range p.reconfigure {
+		if err := g.configureItem(item); err != nil {
+			g.restoreParams(p, i+1)
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreParams delivers the old params to the first n of p.reconfigure.
+func (g *Glean) restoreParams(p *preparedItem, n int) {
+	for _, item := range p.reconfigure[:n] {
+		old := *item
+		old.Params = p.change.Old.Params
+		g.configureItem(&old)
+	}
+}
+
+// lookupItem opens the plugin of item if pp is nil, looks up its symbol and checks the symbol can be assigned to vPtr.
+// vPtr may be nil if nothing is bound to the item.
+func lookupItem(item *PluginItem, pp *plugin.Plugin, vPtr interface{}) (*plugin.Plugin, plugin.Symbol, error) {
+	if pp == nil {
+		var err error
+		pp, err = openPlugin(item.File, item.Hash)
+		if err != nil {
+			log.Errorf("failed to load %s: %v", item.Name, err)
+			return nil, nil, err
 		}
 	}
 
-	for _, item := range currentPluginItems {
-		if _, exist := latestM[item.ID]; !exist {
-			removed = append(removed, item)
+	s, err := pp.Lookup(item.Name)
+	if err != nil {
+		log.Errorf("failed to lookup %s in %s: %v", item.Name, item.File, err)
+		return nil, nil, err
+	}
+
+	if err = checkType(item, s); err != nil {
+		log.Error(err)
+		return nil, nil, err
+	}
+
+	if vPtr != nil {
+		if err = checkSymbol(s, vPtr); err != nil {
+			log.Errorf("symbol %s in %s can not be reloaded: %v", item.Name, item.File, err)
+			return nil, nil, err
 		}
 	}
 
-	return
+	return pp, s, nil
+}
+
+// resolveItems selects items that apply to this process, hashes their plugin files, merges manifests,
+// validates the result and sorts it by dependencies. Skipped items are returned as they are configured.
+// Items without names whose manifests can't be read are returned as failed, and the items of current
+// that are expanded from them are kept.
+func (g *Glean) resolveItems(items, current []*PluginItem) (selected, skipped []*PluginItem, failed []*failure, err error) {
+	selected, skipped = g.selectItems(items)
+	hashItems(selected)
+	selected, failed = expandManifests(selected)
+	selected = append(selected, keepExpanded(current, selected, failed)...)
+	if err = validateItems(selected); err != nil {
+		return nil, nil, nil, err
+	}
+	selected, err = sortItems(selected)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return selected, skipped, failed, nil
+}
+
+func validateItems(items []*PluginItem) error {
+	var err error
+	ids := make(map[string]bool, len(items))
+	for i, item := range items {
+		if item == nil {
+			err = multierror.Append(err, fmt.Errorf("item #%d is null", i))
+			continue
+		}
+		if item.ID == "" {
+			err = multierror.Append(err, fmt.Errorf("item #%d has no id", i))
+		} else if ids[item.ID] {
+			err = multierror.Append(err, fmt.Errorf("item %s is duplicated", item.ID))
+		}
+		if item.File == "" || item.Name == "" {
+			err = multierror.Append(err, fmt.Errorf("item %s must have file and name", item.ID))
+		}
+		if item.Canary != nil {
+			if e := validateCanary(item); e != nil {
+				err = multierror.Append(err, e)
+			}
+		}
+		ids[item.ID] = true
+	}
+	return err
 }
 
 // Reload loads an variable or function from configured plugins.
-func (g *Glean) Reload(id string, vPtr interface{}) error {
+func (g *Glean) Reload(id string, vPtr interface{}, opts ...BindOption) error {
 	if g.closed {
 		return ErrClosed
 	}
 
+	b, err := newBinding(opts)
+	if err != nil {
+		return err
+	}
+
 	g.mu.RLock()
 	item := g.idMap[id]
 	g.mu.RUnlock()
@@ -260,29 +757,46 @@ func (g *Glean) Reload(id string, vPtr interface{}) error {
 	if item == nil {
 		return ErrItemHasNotConfigured
 	}
+	if err = b.checkVersion(item); err != nil {
+		return err
+	}
 
-	return ReloadFromPlugin(item.Cached, item.Name, vPtr)
+	s, err := item.Cached.Lookup(item.Name)
+	if err != nil {
+		return err
+	}
+	return assignSymbol(g.wrap(b, item, s), vPtr)
 }
 
 // Watch watches plugin changes and reload given function/variable automatically.
-func (g *Glean) Watch(id string, vPtr interface{}) {
+// Changes that are refused by options, such as Requires, keep the current version.
+func (g *Glean) Watch(id string, vPtr interface{}, opts ...BindOption) {
+	b, err := newBinding(opts)
+	if err != nil {
+		log.Errorf("invalid options to watch %s: %v", id, err)
+	}
+
 	g.mu.Lock()
+	b.v = vPtr
 	g.watched[id] = true
-	item := g.idMap[id]
-	g.mu.Unlock()
-	if item != nil {
+	g.bindings[id] = b
+	if item := g.idMap[id]; item != nil {
 		item.v = vPtr
+		if s, err := item.Cached.Lookup(item.Name); err == nil {
+			b.bind(item, s)
+		}
 	}
+	g.mu.Unlock()
 }
 
 // ReloadAndWatch loads an variable or function from plugins and begin to watch.
-func (g *Glean) ReloadAndWatch(id string, vPtr interface{}) error {
-	err := g.Reload(id, vPtr)
+func (g *Glean) ReloadAndWatch(id string, vPtr interface{}, opts ...BindOption) error {
+	err := g.Reload(id, vPtr, opts...)
 	if err != nil {
 		return err
 	}
 
-	g.Watch(id, vPtr)
+	g.Watch(id, vPtr, opts...)
 
 	return nil
 }
@@ -320,7 +834,7 @@ func (g *Glean) FindAllPlugins(t reflect.Type) ([]string, error) {
 			}
 		} else {
 			s, err := item.Cached.Lookup(item.Name)
-			if err == nil && reflect.ValueOf(s).Elem().Type().Implements(t) {
+			if err == nil && symbolValue(s).Type().Implements(t) {
 				ids = append(ids, id)
 			}
 		}
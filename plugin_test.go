@@ -4,8 +4,14 @@
 
 package glean
 
-import "testing"
-import "github.com/smallnest/glean/log"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/smallnest/glean/log"
+)
 
 func TestGP_LoadConfig(t *testing.T) {
 	log.SetDummyLogger()
@@ -48,3 +54,75 @@ func TestGP_LoadConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestGlean_AtomicReload(t *testing.T) {
+	log.SetDummyLogger()
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		wantFn int
+		wantV  int
+	}{
+		{
+			name:   "partial",
+			wantFn: 3,
+			wantV:  100,
+		},
+		{
+			name:   "atomic",
+			opts:   []Option{WithAtomicReload()},
+			wantFn: 30,
+			wantV:  100,
+		},
+	}
+
+	latest := []byte(`[
+		{"id":"EF5A35EC-46EB-4E62-8251-78F1A49FA7DC","file":"_example/test/plugins/plugin1/plugin1.so","name":"Add","version":"1.1"},
+		{"id":"2E8FD057-99EC-41B9-8172-0EBF18F9A48D","file":"_example/test/plugins/pluginabc/plugin1.so","name":"V","version":"1.1"}
+	]`)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := copyConfig(t, "plugin_test.json")
+			defer os.RemoveAll(filepath.Dir(file))
+
+			// apply the config without LoadConfig, so no watcher races with checkChanges below.
+			g := New(file, tt.opts...)
+			items, err := g.readConfig()
+			if err != nil {
+				t.Fatalf("failed to read config: %v", err)
+			}
+			if _, err = g.applyLocked(items); err != nil {
+				t.Fatalf("failed to apply config: %v", err)
+			}
+			gen := g.generation
+
+			var fn func(x, y int) int
+			var v int
+			if err := g.ReloadAndWatch("EF5A35EC-46EB-4E62-8251-78F1A49FA7DC", &fn); err != nil {
+				t.Fatalf("failed to reload fn: %v", err)
+			}
+			if err := g.ReloadAndWatch("2E8FD057-99EC-41B9-8172-0EBF18F9A48D", &v); err != nil {
+				t.Fatalf("failed to reload v: %v", err)
+			}
+
+			if err := ioutil.WriteFile(file, latest, 0644); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+			if err := g.checkChanges(); err == nil {
+				t.Errorf("expect an error for the non-existed plugin")
+			}
+
+			if got := fn(1, 2); got != tt.wantFn {
+				t.Errorf("fn(1, 2) = %d, want %d", got, tt.wantFn)
+			}
+			if v != tt.wantV {
+				t.Errorf("v = %d, want %d", v, tt.wantV)
+			}
+			if tt.opts != nil && g.generation != gen {
+				t.Errorf("atomic reload must not bump generation")
+			}
+		})
+	}
+}
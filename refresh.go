@@ -0,0 +1,108 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/smallnest/glean/log"
+)
+
+// WithReloadOnSIGHUP makes Glean call Refresh when the process receives SIGHUP.
+// It takes effect when LoadConfig starts watching.
+func WithReloadOnSIGHUP() Option {
+	return func(g *Glean) {
+		g.sighup = true
+	}
+}
+
+// Refresh reads the config file, or scans the plugin directory, and applies the changes synchronously,
+// just like what a watched change of the config does. It is useful if a change is missed by the watcher.
+// It returns the changes that are applied, without items that failed, and the errors of items that failed.
+// ctx can cancel a refresh that is waiting for another apply to finish.
+func (g *Glean) Refresh(ctx context.Context) (ChangeSet, error) {
+	if err := ctx.Err(); err != nil {
+		return ChangeSet{}, err
+	}
+
+	// read the config under the lock so that it can't be older than what AddItem and others have persisted.
+	if err := g.lockContext(ctx); err != nil {
+		return ChangeSet{}, err
+	}
+	if g.closed {
+		g.mu.Unlock()
+		return ChangeSet{}, ErrClosed
+	}
+	latestPluginItems, err := g.readConfig()
+	if err != nil {
+		g.mu.Unlock()
+		return ChangeSet{}, err
+	}
+	events, err := g.applyLocked(latestPluginItems)
+	g.releaseQuarantineLocked()
+	g.mu.Unlock()
+
+	g.emit(events...)
+
+	var cs ChangeSet
+	for _, e := range events {
+		switch e.Type {
+		case EventAdded:
+			cs.Added = append(cs.Added, e.Item)
+		case EventChanged:
+			cs.Changed = append(cs.Changed, e.Change)
+		case EventRemoved:
+			cs.Removed = append(cs.Removed, e.Item)
+		}
+	}
+	return cs, err
+}
+
+// lockContext locks g.mu unless ctx is done first.
+func (g *Glean) lockContext(ctx context.Context) error {
+	locked := make(chan struct{})
+	go func() {
+		g.mu.Lock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		// the lock is released as soon as it is acquired.
+		go func() {
+			<-locked
+			g.mu.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// watchSIGHUP refreshes on SIGHUP until Glean is closed.
+func (g *Glean) watchSIGHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ch:
+				log.Info("SIGHUP received, refresh plugins")
+				if _, err := g.Refresh(context.Background()); err != nil {
+					log.Errorf("failed to refresh on SIGHUP: %v", err)
+				}
+			case <-g.done:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,81 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/smallnest/glean/log"
+)
+
+func TestGlean_Refresh(t *testing.T) {
+	log.SetDummyLogger()
+
+	file := copyConfig(t, "plugin_test.json")
+	defer os.RemoveAll(filepath.Dir(file))
+
+	g := New(file, WithReloadOnSIGHUP())
+	defer g.Close()
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	cs, err := g.Refresh(context.Background())
+	if err != nil || !cs.Empty() {
+		t.Errorf("expect nothing to be refreshed but got %+v, %v", cs, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = g.Refresh(ctx); err != context.Canceled {
+		t.Errorf("expect context.Canceled but got %v", err)
+	}
+
+	// ctx cancels waiting for another apply.
+	g.mu.Lock()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = g.Refresh(ctx)
+	cancel()
+	g.mu.Unlock()
+	if err != context.DeadlineExceeded {
+		t.Errorf("expect context.DeadlineExceeded but got %v", err)
+	}
+
+	// the watcher may see the change before Refresh, so the item is compared with Snapshot.
+	config := `[{"id":"EF5A35EC-46EB-4E62-8251-78F1A49FA7DC","file":"_example/test/plugins/pluginabc/plugin1.so","name":"Add"},
+		{"id":"add","file":"_example/test/plugins/plugin1/plugin1.so","name":"Add","version":"1.1"}]`
+	if err = ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	cs, err = g.Refresh(context.Background())
+	if err == nil {
+		t.Errorf("expect an error for the missing plugin")
+	}
+	if len(cs.Changed) != 0 {
+		t.Errorf("expect the failed change not to be returned but got %+v", cs.Changed)
+	}
+	if _, ok := g.Snapshot().Item("add"); !ok {
+		t.Errorf("expect add to be refreshed")
+	}
+
+	config = `[{"id":"add","file":"_example/test/plugins/plugin1/plugin1.so","name":"Add","version":"1.2"}]`
+	if err = ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	for i := 0; i < 100; i++ {
+		if item, _ := g.Snapshot().Item("add"); item.Version == "1.2" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expect SIGHUP to refresh the config")
+}
@@ -0,0 +1,217 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"fmt"
+	"strings"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// requirement is an entry of PluginItem.Requires: an item ID or a plugin name in manifests,
+// optionally followed by a version constraint, such as "plugin3 >=3.0, <4".
+type requirement struct {
+	name       string
+	constraint *versionConstraint
+}
+
+func parseRequirement(s string) (requirement, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexAny(s, " <>=!~^")
+	if i < 0 {
+		return requirement{name: s, constraint: &versionConstraint{}}, nil
+	}
+
+	c, err := parseConstraint(s[i:])
+	if err != nil {
+		return requirement{}, err
+	}
+	return requirement{name: s[:i], constraint: c}, nil
+}
+
+// refersTo reports whether item is what r refers to, regardless of its version.
+func (r requirement) refersTo(item *PluginItem) bool {
+	return item.ID == r.name || (item.Plugin != "" && item.Plugin == r.name)
+}
+
+func (r requirement) String() string {
+	if r.constraint.raw == "" {
+		return r.name
+	}
+	return r.name + " " + r.constraint.raw
+}
+
+func parseRequirements(item *PluginItem) ([]requirement, error) {
+	reqs := make([]requirement, 0, len(item.Requires))
+	for _, s := range item.Requires {
+		r, err := parseRequirement(s)
+		if err != nil {
+			return nil, fmt.Errorf("item %s: %v", item.ID, err)
+		}
+		reqs = append(reqs, r)
+	}
+	return reqs, nil
+}
+
+// sortItems sorts items so that every item comes after the items it requires.
+// Otherwise the configured order is kept. It returns an error for invalid requirements or a dependency cycle.
+func sortItems(items []*PluginItem) ([]*PluginItem, error) {
+	var err error
+	deps := make(map[*PluginItem][]*PluginItem, len(items))
+	for _, item := range items {
+		reqs, e := parseRequirements(item)
+		if e != nil {
+			err = multierror.Append(err, e)
+			continue
+		}
+		for _, r := range reqs {
+			for _, dep := range items {
+				if dep != item && r.refersTo(dep) {
+					deps[item] = append(deps[item], dep)
+				}
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]*PluginItem, 0, len(items))
+	done := make(map[*PluginItem]bool, len(items))
+	for len(sorted) < len(items) {
+		progress := false
+		for _, item := range items {
+			if done[item] || !allDone(deps[item], done) {
+				continue
+			}
+			done[item] = true
+			sorted = append(sorted, item)
+			progress = true
+		}
+		if !progress {
+			return nil, fmt.Errorf("dependency cycle: %s", findCycle(items, deps, done))
+		}
+	}
+	return sorted, nil
+}
+
+func allDone(items []*PluginItem, done map[*PluginItem]bool) bool {
+	for _, item := range items {
+		if !done[item] {
+			return false
+		}
+	}
+	return true
+}
+
+// findCycle returns a cycle among items that are not done, such as "a -> b -> a".
+func findCycle(items []*PluginItem, deps map[*PluginItem][]*PluginItem, done map[*PluginItem]bool) string {
+	var path []*PluginItem
+	onPath := make(map[*PluginItem]int)
+	visited := make(map[*PluginItem]bool)
+
+	var visit func(item *PluginItem) string
+	visit = func(item *PluginItem) string {
+		if i, ok := onPath[item]; ok {
+			ids := make([]string, 0, len(path)-i+1)
+			for _, it := range path[i:] {
+				ids = append(ids, it.ID)
+			}
+			return strings.Join(append(ids, item.ID), " -> ")
+		}
+		if visited[item] || done[item] {
+			return ""
+		}
+		visited[item] = true
+		onPath[item] = len(path)
+		path = append(path, item)
+		for _, dep := range deps[item] {
+			if c := visit(dep); c != "" {
+				return c
+			}
+		}
+		path = path[:len(path)-1]
+		delete(onPath, item)
+		return ""
+	}
+
+	for _, item := range items {
+		if c := visit(item); c != "" {
+			return c
+		}
+	}
+	return ""
+}
+
+// checkRequires checks every requirement of item is satisfied by an available item.
+func checkRequires(item *PluginItem, available map[string]*PluginItem) error {
+	reqs, err := parseRequirements(item)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range reqs {
+		satisfied := false
+		for _, a := range available {
+			if a.ID != item.ID && r.refersTo(a) && r.constraint.allows(a.Version) {
+				satisfied = true
+				break
+			}
+		}
+		if !satisfied {
+			return fmt.Errorf("item %s requires %s which is not loaded", item.ID, r)
+		}
+	}
+	return nil
+}
+
+// cascadeChanges adds items that depend on changed or removed items, directly or indirectly, to cs
+// with FieldDependency, so they are checked again and their plugins are restarted. latest must be sorted.
+func cascadeChanges(cs *ChangeSet, current, latest []*PluginItem) {
+	if len(cs.Changed) == 0 && len(cs.Removed) == 0 {
+		return
+	}
+
+	currentM := make(map[string]*PluginItem, len(current))
+	for _, item := range current {
+		currentM[item.ID] = item
+	}
+
+	var affected []*PluginItem
+	skip := make(map[string]bool)
+	for _, c := range cs.Changed {
+		affected = append(affected, c.Old, c.New)
+		skip[c.New.ID] = true
+	}
+	for _, item := range cs.Added {
+		skip[item.ID] = true
+	}
+	affected = append(affected, cs.Removed...)
+
+	for _, item := range latest {
+		old, ok := currentM[item.ID]
+		if !ok || skip[item.ID] {
+			continue
+		}
+		reqs, _ := parseRequirements(item)
+		if !requiresAny(reqs, affected) {
+			continue
+		}
+		cs.Changed = append(cs.Changed, &ItemChange{Old: old, New: item, Fields: []string{FieldDependency}})
+		affected = append(affected, old, item)
+	}
+}
+
+func requiresAny(reqs []requirement, items []*PluginItem) bool {
+	for _, r := range reqs {
+		for _, item := range items {
+			if r.refersTo(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
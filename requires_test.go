@@ -0,0 +1,180 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/smallnest/glean/log"
+)
+
+func TestSortItems(t *testing.T) {
+	tests := []struct {
+		name    string
+		items   []*PluginItem
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "order",
+			items: []*PluginItem{
+				{ID: "a", Requires: []string{"b"}},
+				{ID: "b", Requires: []string{"p >=1"}},
+				{ID: "c", Plugin: "p"},
+				{ID: "d"},
+			},
+			want: []string{"c", "d", "b", "a"},
+		},
+		{
+			name: "cycle",
+			items: []*PluginItem{
+				{ID: "a", Requires: []string{"b"}},
+				{ID: "b", Requires: []string{"c"}},
+				{ID: "c", Requires: []string{"a"}},
+				{ID: "d"},
+			},
+			wantErr: "dependency cycle: a -> b -> c -> a",
+		},
+		{
+			name:    "invalid",
+			items:   []*PluginItem{{ID: "a", Requires: []string{"b >=x"}}},
+			wantErr: "invalid constraint",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sorted, err := sortItems(tt.items)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expect error %q but got %v", tt.wantErr, err)
+				}
+				return
+			}
+			var ids []string
+			for _, item := range sorted {
+				ids = append(ids, item.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("sortItems() = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestGlean_Requires(t *testing.T) {
+	log.SetDummyLogger()
+
+	file := copyConfig(t, "plugin_test.json")
+	defer os.RemoveAll(filepath.Dir(file))
+
+	callsSym, err := LoadSymbol("_example/test/plugins/plugin3/plugin3.so", "Calls")
+	if err != nil {
+		t.Fatalf("failed to load Calls: %v", err)
+	}
+	calls := callsSym.(func() []string)
+	calls()
+
+	g := New(file)
+	defer g.Close()
+
+	tests := []struct {
+		name   string
+		config string
+		active []string
+		calls  []string
+		planOK bool
+		// cascaded are items that Plan shows as changed by their dependencies.
+		cascaded []string
+	}{
+		{
+			name: "load dependency first",
+			config: `[
+				{"id":"t","file":"_example/test/plugins/plugin3/plugin3.so","name":"Threshold","requires":["v >=1"]},
+				{"id":"v","file":"_example/test/plugins/plugin2/plugin2.so","name":"V","version":"1.0"}
+			]`,
+			active: []string{"t", "v"},
+			calls:  []string{"init", "start"},
+			planOK: true,
+		},
+		{
+			name: "restart dependents",
+			config: `[
+				{"id":"t","file":"_example/test/plugins/plugin3/plugin3.so","name":"Threshold","requires":["v >=1"]},
+				{"id":"v","file":"_example/test/plugins/plugin1/plugin1.so","name":"V","version":"1.1"}
+			]`,
+			active:   []string{"t", "v"},
+			calls:    []string{"stop", "init", "start"},
+			planOK:   true,
+			cascaded: []string{"t"},
+		},
+		{
+			name: "unsatisfied version",
+			config: `[
+				{"id":"t","file":"_example/test/plugins/plugin3/plugin3.so","name":"Threshold","requires":["v >=2"]},
+				{"id":"v","file":"_example/test/plugins/plugin1/plugin1.so","name":"V","version":"1.1"}
+			]`,
+			active: []string{"v"},
+			calls:  []string{"stop"},
+			planOK: false,
+		},
+		{
+			name: "requires plugin",
+			config: `[
+				{"id":"t","file":"_example/test/plugins/plugin3/plugin3.so","name":"Threshold","requires":["v"]},
+				{"id":"u","file":"_example/test/plugins/plugin1/plugin1.so","name":"Add","requires":["plugin3 ^3.1"]},
+				{"id":"v","file":"_example/test/plugins/plugin1/plugin1.so","name":"V","version":"1.1"}
+			]`,
+			active: []string{"t", "u", "v"},
+			calls:  []string{"init", "start"},
+			planOK: true,
+		},
+		{
+			name: "remove dependency",
+			config: `[
+				{"id":"t","file":"_example/test/plugins/plugin3/plugin3.so","name":"Threshold","requires":["v"]},
+				{"id":"u","file":"_example/test/plugins/plugin1/plugin1.so","name":"Add","requires":["plugin3 ^3.1"]}
+			]`,
+			calls:    []string{"stop"},
+			cascaded: []string{"t", "u"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := g.Plan([]byte(tt.config))
+			if err != nil {
+				t.Fatalf("failed to plan: %v", err)
+			}
+			if p.OK() != tt.planOK {
+				t.Errorf("Plan() OK = %v, want %v: %v", p.OK(), tt.planOK, p.Errors)
+			}
+			var cascaded []string
+			for _, c := range p.Changed {
+				if c.Has(FieldDependency) {
+					cascaded = append(cascaded, c.New.ID)
+				}
+			}
+			if !reflect.DeepEqual(cascaded, tt.cascaded) {
+				t.Errorf("Plan() cascaded = %v, want %v", cascaded, tt.cascaded)
+			}
+			if err := ioutil.WriteFile(file, []byte(tt.config), 0644); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+			g.checkChanges()
+
+			if got := g.Snapshot().IDs(); !reflect.DeepEqual(got, tt.active) && len(got)+len(tt.active) > 0 {
+				t.Errorf("active items = %v, want %v", got, tt.active)
+			}
+			if got := calls(); !reflect.DeepEqual(got, tt.calls) {
+				t.Errorf("calls = %v, want %v", got, tt.calls)
+			}
+		})
+	}
+}
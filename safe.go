@@ -0,0 +1,153 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"fmt"
+	"plugin"
+	"reflect"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/smallnest/glean/log"
+	"github.com/smallnest/glean/metrics"
+)
+
+// PluginPanicError is a panic of a bound function that is recovered by Glean.
+type PluginPanicError struct {
+	ID      string
+	Version string
+	File    string
+	// Value is the value passed to panic.
+	Value interface{}
+	// Stack is the stack of the panicking goroutine.
+	Stack []byte
+}
+
+func (e *PluginPanicError) Error() string {
+	return fmt.Sprintf("%s of version %q in %s panicked: %v", e.ID, e.Version, e.File, e.Value)
+}
+
+// Recover makes the bound function recover panics of the plugin instead of crashing the caller.
+// A recovered panic is logged, counted as glean_recovered_panics_total{id, version} and sent as EventPanicked.
+// If the last result of the function is an error, the *PluginPanicError is returned there,
+// and other results are zero values.
+func Recover() BindOption {
+	return func(b *binding) error {
+		b.recover = true
+		return nil
+	}
+}
+
+// Fallback is Recover, and a call that panics is retried on the previous version of the item
+// that has been bound to the function, if there is one. The plugin of the previous version is kept started
+// until another version replaces it.
+func Fallback() BindOption {
+	return func(b *binding) error {
+		b.recover = true
+		b.fallback = true
+		return nil
+	}
+}
+
+// RollbackAfterPanics is Recover, and the item is rolled back to its previous version by Rollback
+// once the current version has panicked n times. Like CircuitBreaker, the version is quarantined and EventRolledBack is sent.
+func RollbackAfterPanics(n int) BindOption {
+	return func(b *binding) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid panic threshold %d", n)
+		}
+		b.recover = true
+		b.rollbackAfter = n
+		return nil
+	}
+}
+
+// boundSymbol is a version of the item that is bound to a function or variable.
+type boundSymbol struct {
+	item *PluginItem
+	sym  plugin.Symbol
+}
+
+// sameVersion reports whether item is the same version as bs.
+func (bs *boundSymbol) sameVersion(item *PluginItem) bool {
+	return bs.item.Hash == item.Hash && bs.item.Version == item.Version
+}
+
+// bind records s of item as the current version of the binding and keeps the previous version for Fallback.
+func (b *binding) bind(item *PluginItem, s plugin.Symbol) {
+	if b.cur != nil && !b.cur.sameVersion(item) {
+		b.prev = b.cur
+	}
+	b.cur = &boundSymbol{item: item, sym: s}
+}
+
+// recoverFunc wraps fn to recover its panics.
+func (g *Glean) recoverFunc(b *binding, item *PluginItem, fn reflect.Value) reflect.Value {
+	t := fn.Type()
+	errIndex := -1
+	if n := t.NumOut(); n > 0 && t.Out(n-1) == errorType {
+		errIndex = n - 1
+	}
+
+	var prev reflect.Value
+	var prevItem *PluginItem
+	if b.fallback && b.prev != nil {
+		if pv := reflect.ValueOf(b.prev.sym); pv.Kind() == reflect.Func && pv.Type() == t {
+			prev, prevItem = pv, b.prev.item
+		}
+	}
+
+	var panics int64
+	return reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+		out, perr := callRecovered(item, fn, in)
+		if perr == nil {
+			return out
+		}
+		g.panicked(b, item, perr, atomic.AddInt64(&panics, 1))
+
+		if prev.IsValid() {
+			var e *PluginPanicError
+			if out, e = callRecovered(prevItem, prev, in); e == nil {
+				return out
+			}
+			g.panicked(b, prevItem, e, 0)
+		}
+		return zeroResults(t, errIndex, perr)
+	})
+}
+
+// callRecovered calls fn and returns the panic of fn as a *PluginPanicError.
+func callRecovered(item *PluginItem, fn reflect.Value, in []reflect.Value) (out []reflect.Value, perr *PluginPanicError) {
+	defer func() {
+		if r := recover(); r != nil {
+			perr = &PluginPanicError{ID: item.ID, Version: item.Version, File: item.File, Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return callFunc(fn, in), nil
+}
+
+// panicked reports a recovered panic. n is how many times the version has panicked, or 0 if it is not counted.
+func (g *Glean) panicked(b *binding, item *PluginItem, perr *PluginPanicError, n int64) {
+	log.Errorf("%v\n%s", perr, perr.Stack)
+	metrics.Add("glean_recovered_panics_total", 1, "id", item.ID, "version", item.Version)
+	g.emit(Event{Type: EventPanicked, ID: item.ID, Item: item, Err: perr})
+
+	if b.rollbackAfter > 0 && n == int64(b.rollbackAfter) {
+		g.revert(item, fmt.Errorf("panicked %d times", n))
+	}
+}
+
+// zeroResults returns zero values of the results of t, with err as the error result at errIndex.
+func zeroResults(t reflect.Type, errIndex int, err error) []reflect.Value {
+	out := make([]reflect.Value, t.NumOut())
+	for i := range out {
+		out[i] = reflect.Zero(t.Out(i))
+	}
+	if errIndex >= 0 {
+		out[errIndex] = reflect.ValueOf(&err).Elem()
+	}
+	return out
+}
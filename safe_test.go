@@ -0,0 +1,151 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"plugin"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smallnest/glean/log"
+)
+
+func TestGlean_Recover(t *testing.T) {
+	log.SetDummyLogger()
+
+	g := New("")
+	b, _ := newBinding([]BindOption{Recover()})
+	item := &PluginItem{ID: "a", File: "a.so", Version: "1.0"}
+
+	var fn func(x int) (int, error)
+	err := assignSymbol(g.wrap(b, item, func(x int) (int, error) {
+		if x == 0 {
+			panic("boom")
+		}
+		return x, nil
+	}), &fn)
+	if err != nil {
+		t.Fatalf("failed to assign fn: %v", err)
+	}
+
+	if n, err := fn(1); n != 1 || err != nil {
+		t.Errorf("fn(1) = %d, %v", n, err)
+	}
+	n, err := fn(0)
+	perr, ok := err.(*PluginPanicError)
+	if n != 0 || !ok {
+		t.Fatalf("expect a PluginPanicError but got %d, %v", n, err)
+	}
+	if perr.ID != "a" || perr.Version != "1.0" || perr.Value != "boom" || len(perr.Stack) == 0 {
+		t.Errorf("unexpected panic error: %+v", perr)
+	}
+}
+
+func TestGlean_Fallback(t *testing.T) {
+	log.SetDummyLogger()
+
+	g := newWrapTestGlean(t)
+	defer g.Close()
+
+	var mu sync.Mutex
+	var panicked []string
+	g.OnEvent(func(e Event) {
+		if e.Type == EventPanicked {
+			mu.Lock()
+			panicked = append(panicked, e.Item.Version)
+			mu.Unlock()
+		}
+	})
+
+	// plugin2 Div returns -1 for 0 and plugin1 Div panics.
+	err := g.UpdateItem(PluginItem{ID: "div", File: "_example/test/plugins/plugin2/plugin2.so", Name: "Div", Version: "1.0"})
+	if err != nil {
+		t.Fatalf("failed to update div: %v", err)
+	}
+	var div func(x, y int) int
+	if err = g.ReloadAndWatch("div", &div, Fallback(), RollbackAfterPanics(2)); err != nil {
+		t.Fatalf("failed to reload div: %v", err)
+	}
+	err = g.UpdateItem(PluginItem{ID: "div", File: "_example/test/plugins/plugin1/plugin1.so", Name: "Div", Version: "1.1"})
+	if err != nil {
+		t.Fatalf("failed to update div: %v", err)
+	}
+
+	if got := div(6, 3); got != 2 {
+		t.Errorf("div(6, 3) = %d, want 2", got)
+	}
+	if got := div(1, 0); got != -1 {
+		t.Errorf("expect div(1, 0) to fall back to 1.0 but got %d", got)
+	}
+	div(1, 0)
+
+	// the second panic rolls div back to 1.0.
+	for i := 0; i < 100; i++ {
+		if item, _ := g.Snapshot().Item("div"); item.Version == "1.0" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if item, _ := g.Snapshot().Item("div"); item.Version != "1.0" {
+		t.Fatalf("expect div to be rolled back but got %s", item.Version)
+	}
+	if got := div(1, 0); got != -1 {
+		t.Errorf("expect div(1, 0) of 1.0 to return -1 but got %d", got)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(panicked) != 2 || panicked[0] != "1.1" || panicked[1] != "1.1" {
+		t.Errorf("unexpected panic events: %v", panicked)
+	}
+}
+
+func TestGlean_FallbackStarted(t *testing.T) {
+	log.SetDummyLogger()
+
+	g := newWrapTestGlean(t)
+	defer g.Close()
+
+	so := "_example/test/plugins/plugin3/plugin3.so"
+	if err := g.AddItem(PluginItem{ID: "t", File: so, Name: "Threshold", Version: "1.0"}); err != nil {
+		t.Fatalf("failed to add t: %v", err)
+	}
+	var threshold func() int
+	if err := g.ReloadAndWatch("t", &threshold, Fallback()); err != nil {
+		t.Fatalf("failed to reload t: %v", err)
+	}
+	p, err := plugin.Open(so)
+	if err != nil {
+		t.Fatalf("failed to open plugin3: %v", err)
+	}
+	s, err := p.Lookup("Calls")
+	if err != nil {
+		t.Fatalf("failed to look up Calls: %v", err)
+	}
+	calls := s.(func() []string)
+	calls()
+
+	// plugin1 Threshold panics, so calls fall back to plugin3, which must not be stopped.
+	err = g.UpdateItem(PluginItem{ID: "t", File: "_example/test/plugins/plugin1/plugin1.so", Name: "Threshold", Version: "1.1"})
+	if err != nil {
+		t.Fatalf("failed to update t: %v", err)
+	}
+	if got := calls(); len(got) != 0 {
+		t.Errorf("expect plugin3 to be kept started but got %v", got)
+	}
+	if got := threshold(); got != 1 {
+		t.Errorf("expect threshold() to fall back to plugin3 but got %d", got)
+	}
+
+	// plugin3 is stopped once another version replaces it as the previous version.
+	err = g.UpdateItem(PluginItem{ID: "t", File: "_example/test/plugins/plugin1/plugin1.so", Name: "Threshold", Version: "1.2"})
+	if err != nil {
+		t.Fatalf("failed to update t: %v", err)
+	}
+	if got := calls(); len(got) != 1 || got[0] != "stop" {
+		t.Errorf("expect plugin3 to be stopped but got %v", got)
+	}
+}
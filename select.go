@@ -0,0 +1,86 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+
+	"github.com/smallnest/glean/log"
+)
+
+// WithProfile sets the profile of this process, such as "staging". The default is $GLEAN_PROFILE.
+// Items of the profile in the config are overlaid on other items,
+// and items that list profiles are only loaded if the profile is one of them.
+func WithProfile(profile string) Option {
+	return func(g *Glean) {
+		g.profile = profile
+	}
+}
+
+// WithLabels sets labels of this process, such as {"fleet": "edge"}.
+// Items that have labels are only loaded if all of their labels have the same values here.
+func WithLabels(labels map[string]string) Option {
+	return func(g *Glean) {
+		g.labels = make(map[string]string, len(labels))
+		for k, v := range labels {
+			g.labels[k] = v
+		}
+	}
+}
+
+// selectItems splits items into those that apply to this process and those that don't.
+// Selection happens before manifests are read, so plugins of skipped items are never opened.
+func (g *Glean) selectItems(items []*PluginItem) (selected, skipped []*PluginItem) {
+	for _, item := range items {
+		if item != nil {
+			if reason := g.skipReason(item); reason != "" {
+				log.Debugf("skip %s: %s", item.ID, reason)
+				skipped = append(skipped, item)
+				continue
+			}
+		}
+		selected = append(selected, item)
+	}
+	return selected, skipped
+}
+
+// skipReason returns why item doesn't apply to this process, or "" if it does.
+func (g *Glean) skipReason(item *PluginItem) string {
+	if item.Enabled != nil && !*item.Enabled {
+		return "disabled"
+	}
+	if len(item.GOOS) > 0 && !contains(item.GOOS, runtime.GOOS) {
+		return fmt.Sprintf("goos %s is not in %v", runtime.GOOS, item.GOOS)
+	}
+	if len(item.GOARCH) > 0 && !contains(item.GOARCH, runtime.GOARCH) {
+		return fmt.Sprintf("goarch %s is not in %v", runtime.GOARCH, item.GOARCH)
+	}
+	if len(item.Profiles) > 0 && !contains(item.Profiles, g.profile) {
+		return fmt.Sprintf("profile %q is not in %v", g.profile, item.Profiles)
+	}
+
+	keys := make([]string, 0, len(item.Labels))
+	for k := range item.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v, ok := g.labels[k]; !ok || v != item.Labels[k] {
+			return fmt.Sprintf("label %s=%s does not match", k, item.Labels[k])
+		}
+	}
+	return ""
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
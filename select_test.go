@@ -0,0 +1,180 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/smallnest/glean/log"
+)
+
+func TestGlean_SkipReason(t *testing.T) {
+	g := New("", WithProfile("staging"), WithLabels(map[string]string{"fleet": "edge"}))
+	disabled, enabled := false, true
+
+	tests := []struct {
+		name string
+		item PluginItem
+		skip bool
+	}{
+		{name: "default", item: PluginItem{}},
+		{name: "enabled", item: PluginItem{Enabled: &enabled}},
+		{name: "disabled", item: PluginItem{Enabled: &disabled}, skip: true},
+		{name: "goos", item: PluginItem{GOOS: []string{"plan9", runtime.GOOS}}},
+		{name: "other goos", item: PluginItem{GOOS: []string{"plan9"}}, skip: true},
+		{name: "goarch", item: PluginItem{GOARCH: []string{runtime.GOARCH}}},
+		{name: "other goarch", item: PluginItem{GOARCH: []string{"mips"}}, skip: true},
+		{name: "profile", item: PluginItem{Profiles: []string{"staging", "dev"}}},
+		{name: "other profile", item: PluginItem{Profiles: []string{"prod"}}, skip: true},
+		{name: "labels", item: PluginItem{Labels: map[string]string{"fleet": "edge"}}},
+		{name: "other labels", item: PluginItem{Labels: map[string]string{"fleet": "core"}}, skip: true},
+		{name: "missing labels", item: PluginItem{Labels: map[string]string{"fleet": "edge", "zone": "a"}}, skip: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := g.skipReason(&tt.item); (got != "") != tt.skip {
+				t.Errorf("skipReason() = %q, want skip %v", got, tt.skip)
+			}
+		})
+	}
+}
+
+func TestGlean_DisableItem(t *testing.T) {
+	log.SetDummyLogger()
+
+	file := copyConfig(t, "plugin_test.json")
+	defer os.RemoveAll(filepath.Dir(file))
+
+	g := New(file, WithPersist())
+	defer g.Close()
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	id := "EF5A35EC-46EB-4E62-8251-78F1A49FA7DC"
+	var fn func(x, y int) int
+	if err := g.ReloadAndWatch(id, &fn); err != nil {
+		t.Fatalf("failed to reload fn: %v", err)
+	}
+
+	disabled := false
+	err := g.UpdateItem(PluginItem{ID: id, File: "_example/test/plugins/plugin1/plugin1.so", Name: "Add", Version: "1.1", Enabled: &disabled})
+	if err != nil {
+		t.Fatalf("failed to disable item: %v", err)
+	}
+	if _, ok := g.Snapshot().Item(id); ok {
+		t.Errorf("a disabled item must not be active")
+	}
+	if got := fn(1, 2); got != 0 {
+		t.Errorf("expect fn of a disabled item to be unbound but got %d", got)
+	}
+
+	status := g.Status()
+	if len(status) != 2 || status[1].ID != id || status[1].Active || status[1].Skipped != "disabled" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	// the disabled item is persisted and can be enabled again.
+	g2 := New(file)
+	defer g2.Close()
+	if err = g2.LoadConfig(); err != nil {
+		t.Fatalf("failed to load persisted config: %v", err)
+	}
+	if _, ok := g2.Snapshot().Item(id); ok || len(g2.Status()) != 2 {
+		t.Errorf("unexpected status of persisted config: %+v", g2.Status())
+	}
+
+	if err = g.UpdateItem(PluginItem{ID: id, File: "_example/test/plugins/plugin1/plugin1.so", Name: "Add", Version: "1.1"}); err != nil {
+		t.Fatalf("failed to enable item: %v", err)
+	}
+	if item, ok := g.Snapshot().Item(id); !ok || item.Version != "1.1" {
+		t.Errorf("expect the item to be enabled but got %+v", item)
+	}
+	if got := fn(1, 2); got != 3 {
+		t.Errorf("expect the enabled item to reload fn but got %d", got)
+	}
+
+	// the watch survives disabling, so later changes are reloaded too.
+	if err = g.SetItemEnabled(id, false); err != nil {
+		t.Fatalf("failed to disable item: %v", err)
+	}
+	if err = g.SetItemEnabled(id, true); err != nil {
+		t.Fatalf("failed to enable item: %v", err)
+	}
+	if err = g.UpdateItem(PluginItem{ID: id, File: "_example/test/plugins/plugin2/plugin2.so", Name: "Add", Version: "1.2"}); err != nil {
+		t.Fatalf("failed to update item: %v", err)
+	}
+	if got := fn(1, 2); got != 30 {
+		t.Errorf("expect the re-enabled item to reload fn but got %d", got)
+	}
+	for _, st := range g.Status() {
+		if st.ID == id && !st.Watched {
+			t.Errorf("expect the re-enabled item to be watched: %+v", st)
+		}
+	}
+}
+
+func TestGlean_DisableItemStops(t *testing.T) {
+	log.SetDummyLogger()
+
+	g := New("plugin_test.json")
+	defer g.Close()
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	so := "_example/test/plugins/plugin3/plugin3.so"
+	callsSym, err := LoadSymbol(so, "Calls")
+	if err != nil {
+		t.Fatalf("failed to load Calls: %v", err)
+	}
+	calls := callsSym.(func() []string)
+
+	if err = g.AddItem(PluginItem{ID: "t", File: so, Name: "Threshold", Params: json.RawMessage(`{"threshold": 3}`)}); err != nil {
+		t.Fatalf("failed to add t: %v", err)
+	}
+	var threshold func() int
+	if err = g.ReloadAndWatch("t", &threshold); err != nil {
+		t.Fatalf("failed to reload t: %v", err)
+	}
+	calls()
+
+	tests := []struct {
+		name      string
+		enabled   bool
+		calls     []string
+		threshold int
+	}{
+		{"disable", false, []string{"stop"}, 0},
+		{"enable", true, []string{"init", "start"}, 3},
+	}
+	for _, tt := range tests {
+		if err = g.SetItemEnabled("t", tt.enabled); err != nil {
+			t.Fatalf("%s: failed to set enabled: %v", tt.name, err)
+		}
+		if got := calls(); !reflect.DeepEqual(got, tt.calls) {
+			t.Errorf("%s: calls = %v, want %v", tt.name, got, tt.calls)
+		}
+		if got := threshold(); got != tt.threshold {
+			t.Errorf("%s: threshold() = %d, want %d", tt.name, got, tt.threshold)
+		}
+	}
+
+	// a function that returns an error gets ErrItemDisabled.
+	fn := func() error { return nil }
+	g.mu.Lock()
+	g.bindings["t"].v = &fn
+	g.unbindLocked("t")
+	g.mu.Unlock()
+	if err = fn(); err != ErrItemDisabled {
+		t.Errorf("expect ErrItemDisabled but got %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semver is a semantic version such as 1.2.3 or v1.2.0-beta.
+// Missing minor and patch numbers are zero and build metadata is ignored.
+type semver struct {
+	major, minor, patch int
+	pre                 string
+}
+
+func parseSemver(s string) (semver, error) {
+	var v semver
+	str := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(str, '+'); i >= 0 {
+		str = str[:i]
+	}
+	if i := strings.IndexByte(str, '-'); i >= 0 {
+		str, v.pre = str[:i], str[i+1:]
+	}
+
+	parts := strings.Split(str, ".")
+	if len(parts) > 3 || str == "" {
+		return v, fmt.Errorf("invalid version %q", s)
+	}
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		*nums[i] = n
+	}
+	return v, nil
+}
+
+// compare returns -1, 0 or 1. A pre-release is lower than its release.
+// Pre-releases are compared by their dot-separated identifiers, numeric ones as numbers.
+func (v semver) compare(o semver) int {
+	for _, d := range []int{v.major - o.major, v.minor - o.minor, v.patch - o.patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+
+	switch {
+	case v.pre == o.pre:
+		return 0
+	case v.pre == "":
+		return 1
+	case o.pre == "":
+		return -1
+	default:
+		return comparePrerelease(v.pre, o.pre)
+	}
+}
+
+// comparePrerelease compares two pre-releases as semver 2.0.0 does: numeric identifiers are compared as numbers
+// and are lower than alphanumeric ones, and a shorter pre-release is lower if all its identifiers are equal.
+func comparePrerelease(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, xerr := strconv.Atoi(as[i])
+		y, yerr := strconv.Atoi(bs[i])
+		switch {
+		case xerr == nil && yerr == nil:
+			if x != y {
+				return sign(x - y)
+			}
+		case xerr == nil:
+			return -1
+		case yerr == nil:
+			return 1
+		default:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return sign(len(as) - len(bs))
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// sameRelease reports whether v and o have the same major, minor and patch numbers.
+func (v semver) sameRelease(o semver) bool {
+	return v.major == o.major && v.minor == o.minor && v.patch == o.patch
+}
+
+type versionClause struct {
+	op string
+	v  semver
+}
+
+func (c versionClause) allows(v semver) bool {
+	r := v.compare(c.v)
+	switch c.op {
+	case "=":
+		return r == 0
+	case "!=":
+		return r != 0
+	case ">":
+		return r > 0
+	case ">=":
+		return r >= 0
+	case "<":
+		return r < 0
+	default: // "<="
+		return r <= 0
+	}
+}
+
+// versionConstraint is a set of clauses that must all be satisfied, such as ">=1.2, <2".
+// Besides comparisons, ^1.2 means >=1.2, <2 and ~1.2.3 means >=1.2.3, <1.3.
+// A pre-release, such as 2.0.0-beta, is only allowed by a constraint that has a clause naming a pre-release
+// of the same version, such as ">=2.0.0-alpha", so "<2" doesn't allow it.
+// An empty constraint or * allows any version.
+type versionConstraint struct {
+	raw     string
+	clauses []versionClause
+}
+
+func parseConstraint(s string) (*versionConstraint, error) {
+	c := &versionConstraint{raw: strings.TrimSpace(s)}
+	if c.raw == "" || c.raw == "*" {
+		return c, nil
+	}
+
+	for _, part := range strings.FieldsFunc(c.raw, func(r rune) bool { return r == ',' }) {
+		part = strings.TrimSpace(part)
+		rest := strings.TrimLeft(part, "<>=!~^")
+		op := part[:len(part)-len(rest)]
+		v, err := parseSemver(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid constraint %q: %v", s, err)
+		}
+
+		switch op {
+		case "", "=", "==":
+			c.clauses = append(c.clauses, versionClause{"=", v})
+		case "!=", ">", ">=", "<", "<=":
+			c.clauses = append(c.clauses, versionClause{op, v})
+		case "^":
+			upper := semver{major: v.major + 1}
+			if v.major == 0 {
+				upper = semver{minor: v.minor + 1}
+			}
+			c.clauses = append(c.clauses, versionClause{">=", v}, versionClause{"<", upper})
+		case "~":
+			c.clauses = append(c.clauses, versionClause{">=", v}, versionClause{"<", semver{major: v.major, minor: v.minor + 1}})
+		default:
+			return nil, fmt.Errorf("invalid constraint %q: unknown operator %q", s, op)
+		}
+	}
+	return c, nil
+}
+
+// allows reports whether version satisfies the constraint. An invalid version only satisfies an empty constraint.
+func (c *versionConstraint) allows(version string) bool {
+	if len(c.clauses) == 0 {
+		return true
+	}
+	v, err := parseSemver(version)
+	if err != nil {
+		return false
+	}
+	// a pre-release is only allowed by a clause that names a pre-release of the same version.
+	allowed := v.pre == ""
+	for _, clause := range c.clauses {
+		if !clause.allows(v) {
+			return false
+		}
+		if clause.v.pre != "" && clause.v.sameRelease(v) {
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+func (c *versionConstraint) String() string {
+	return c.raw
+}
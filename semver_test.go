@@ -0,0 +1,96 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"testing"
+)
+
+func TestSemver_Compare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"v1.2", "1.2.0", 0},
+		{"1.0.0+build.1", "1.0.0", 0},
+		{"1.0.0", "1.0.1", -1},
+		{"1.10.0", "1.9.0", 1},
+		{"1.0.0-alpha", "1.0.0", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.10", -1},
+		{"1.0.0-beta.11", "1.0.0-rc.1", -1},
+		{"1.0.0-rc.1", "1.0.0-rc.1", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			a, err := parseSemver(tt.a)
+			if err != nil {
+				t.Fatalf("parseSemver(%q) error = %v", tt.a, err)
+			}
+			b, err := parseSemver(tt.b)
+			if err != nil {
+				t.Fatalf("parseSemver(%q) error = %v", tt.b, err)
+			}
+			if got := a.compare(b); got != tt.want {
+				t.Errorf("compare() = %d, want %d", got, tt.want)
+			}
+			if got := b.compare(a); got != -tt.want {
+				t.Errorf("reversed compare() = %d, want %d", got, -tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{"", "anything", true},
+		{"*", "1.0", true},
+		{"1.2", "1.2.0", true},
+		{"=1.2", "v1.2", true},
+		{">=1.2, <2", "1.9.9", true},
+		{">=1.2, <2", "2.0", false},
+		{">=1.2, <2", "1.1", false},
+		{">=1.2,<2", "2.0.0-beta", false},
+		{"<2", "2.0.0-beta", false},
+		{">=1.2", "1.5.0-rc.1", false},
+		{">=2.0.0-alpha, <2.0.0", "2.0.0-beta", true},
+		{">=2.0.0-beta.2", "2.0.0-beta.10", true},
+		{"<2.0.0-beta.10", "2.0.0-beta.2", true},
+		{">=2.0.0-alpha", "2.1.0-alpha", false},
+		{">=2.0.0-alpha", "2.1.0", true},
+		{"=1.0.0-rc.1", "1.0.0-rc.1", true},
+		{"*", "1.0.0-rc.1", true},
+		{"!=1.0", "1.0.0", false},
+		{"^1.2", "1.8", true},
+		{"^1.2", "2.0", false},
+		{"^0.2", "0.3", false},
+		{"~1.2.3", "1.2.9", true},
+		{"~1.2.3", "1.3.0", false},
+		{">1.0", "not a version", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.constraint+" "+tt.version, func(t *testing.T) {
+			c, err := parseConstraint(tt.constraint)
+			if err != nil {
+				t.Fatalf("parseConstraint() error = %v", err)
+			}
+			if got := c.allows(tt.version); got != tt.want {
+				t.Errorf("allows(%q) = %v, want %v", tt.version, got, tt.want)
+			}
+		})
+	}
+
+	for _, s := range []string{">=a", "=>1", "1.2.3.4", "<>1"} {
+		if _, err := parseConstraint(s); err == nil {
+			t.Errorf("expect an error for %q", s)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"fmt"
+	"reflect"
+	"runtime/debug"
+
+	"github.com/smallnest/glean/log"
+	"github.com/smallnest/glean/metrics"
+)
+
+// ShadowMismatchError describes a call whose results of the shadow differ from the results of the current version.
+type ShadowMismatchError struct {
+	ID string
+	// Version is the version that serves the call and ShadowVersion is the version in the shadow.
+	Version       string
+	ShadowVersion string
+	Args          []interface{}
+	// Current are the results that are returned, and Shadow are the results of the shadow.
+	Current []interface{}
+	Shadow  []interface{}
+	// Panic is the value passed to panic if the shadow panicked.
+	Panic interface{}
+}
+
+func (e *ShadowMismatchError) Error() string {
+	if e.Panic != nil {
+		return fmt.Sprintf("shadow %q of %s panicked for %v: %v", e.ShadowVersion, e.ID, e.Args, e.Panic)
+	}
+	return fmt.Sprintf("shadow %q of %s returned %v but %q returned %v for %v",
+		e.ShadowVersion, e.ID, e.Shadow, e.Version, e.Current, e.Args)
+}
+
+// ShadowCompare sets how results of the current version and the shadow are compared for a canary in shadow mode.
+// equal gets the results of both versions and reports whether they match. The default is reflect.DeepEqual.
+func ShadowCompare(equal func(current, shadow []interface{}) bool) BindOption {
+	return func(b *binding) error {
+		b.shadowCompare = equal
+		return nil
+	}
+}
+
+// shadowFunc returns a function that calls fn of the item and, for sampled calls, calls sfn of the shadow too
+// and compares their results. The shadow runs after fn and before the call returns, so it sees the same arguments
+// and adds its latency to sampled calls. The results of fn are always returned.
+// Calls are sampled like they are routed to a canary, so CanaryKey makes sampling sticky.
+func (g *Glean) shadowFunc(b *binding, item, shadow *PluginItem, fn, sfn reflect.Value) reflect.Value {
+	equal := b.shadowCompare
+	if equal == nil {
+		equal = func(current, shadow []interface{}) bool { return reflect.DeepEqual(current, shadow) }
+	}
+	percent := item.Canary.Percent
+	key := b.canaryKey
+
+	return reflect.MakeFunc(fn.Type(), func(in []reflect.Value) []reflect.Value {
+		out := callFunc(fn, in)
+		if routeToCanary(key, in, percent) {
+			g.runShadow(item, shadow, sfn, in, out, equal)
+		}
+		return out
+	})
+}
+
+// runShadow calls sfn of the shadow with in and reports a mismatch if its results are not equal to out.
+func (g *Glean) runShadow(item, shadow *PluginItem, sfn reflect.Value, in, out []reflect.Value,
+	equal func(current, shadow []interface{}) bool) {
+	metrics.Add("glean_shadow_calls_total", 1, "id", shadow.ID, "version", shadow.Version)
+	e := &ShadowMismatchError{
+		ID:            item.ID,
+		Version:       item.Version,
+		ShadowVersion: shadow.Version,
+		Args:          interfaces(in),
+		Current:       interfaces(out),
+	}
+	var sout []reflect.Value
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				e.Panic = r
+				log.Errorf("shadow %q of %s panicked: %v\n%s", shadow.Version, shadow.ID, r, debug.Stack())
+			}
+		}()
+		sout = callFunc(sfn, in)
+	}()
+	if e.Panic == nil {
+		e.Shadow = interfaces(sout)
+		if equal(e.Current, e.Shadow) {
+			return
+		}
+	}
+	metrics.Add("glean_shadow_mismatches_total", 1, "id", shadow.ID, "version", shadow.Version)
+	g.emit(Event{Type: EventShadowMismatch, ID: item.ID, Item: shadow, Err: e})
+}
+
+// interfaces returns the values of vs as interfaces.
+func interfaces(vs []reflect.Value) []interface{} {
+	is := make([]interface{}, len(vs))
+	for i, v := range vs {
+		is[i] = v.Interface()
+	}
+	return is
+}
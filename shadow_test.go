@@ -0,0 +1,124 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/smallnest/glean/log"
+	"github.com/smallnest/glean/metrics"
+)
+
+func TestGlean_Shadow(t *testing.T) {
+	log.SetDummyLogger()
+	m := metrics.NewExpvarMetrics("")
+	metrics.SetMetrics(m)
+	defer metrics.SetDummyMetrics()
+
+	tests := []struct {
+		name     string
+		opts     []BindOption
+		mismatch bool
+	}{
+		{"deep equal", nil, true},
+		{"custom compare", []BindOption{ShadowCompare(func(current, shadow []interface{}) bool {
+			return current[0].(int) == shadow[0].(int)*10
+		})}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := New("plugin_test.json")
+			defer g.Close()
+			if err := g.LoadConfig(); err != nil {
+				t.Fatalf("failed to load config: %v", err)
+			}
+
+			mismatches := make(chan Event, 10)
+			g.OnEvent(func(e Event) {
+				if e.Type == EventShadowMismatch {
+					mismatches <- e
+				}
+			})
+
+			id := "EF5A35EC-46EB-4E62-8251-78F1A49FA7DC"
+			var add func(x, y int) int
+			if err := g.ReloadAndWatch(id, &add, tt.opts...); err != nil {
+				t.Fatalf("failed to reload add: %v", err)
+			}
+			// plugin2 Add returns (x + y) * 10 and plugin1 Add returns x + y.
+			err := g.UpdateItem(PluginItem{ID: id, File: "_example/test/plugins/plugin2/plugin2.so", Name: "Add", Version: "1.0",
+				Canary: &CanaryConfig{File: "_example/test/plugins/plugin1/plugin1.so", Version: "1.1", Percent: 100, Shadow: true}})
+			if err != nil {
+				t.Fatalf("failed to update add: %v", err)
+			}
+
+			// the shadow runs before the call returns.
+			calls := m.Counter("glean_shadow_calls_total", "id", id, "version", "1.1")
+			if got := add(1, 2); got != 30 {
+				t.Errorf("expect the current version to serve but got %d", got)
+			}
+			if m.Counter("glean_shadow_calls_total", "id", id, "version", "1.1") != calls+1 {
+				t.Fatal("expect the shadow to be called")
+			}
+
+			select {
+			case e := <-mismatches:
+				merr, ok := e.Err.(*ShadowMismatchError)
+				if !tt.mismatch || !ok {
+					t.Fatalf("unexpected mismatch: %v", e.Err)
+				}
+				if merr.Version != "1.0" || merr.ShadowVersion != "1.1" || merr.Current[0] != 30 || merr.Shadow[0] != 3 {
+					t.Errorf("unexpected mismatch: %+v", merr)
+				}
+			default:
+				if tt.mismatch {
+					t.Fatal("expect a mismatch")
+				}
+			}
+		})
+	}
+}
+
+func TestGlean_ShadowKey(t *testing.T) {
+	log.SetDummyLogger()
+	m := metrics.NewExpvarMetrics("")
+	metrics.SetMetrics(m)
+	defer metrics.SetDummyMetrics()
+
+	g := New("plugin_test.json")
+	defer g.Close()
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	id := "EF5A35EC-46EB-4E62-8251-78F1A49FA7DC"
+	var add func(x, y int) int
+	key := CanaryKey(func(args []interface{}) string { return fmt.Sprint(args[0]) })
+	if err := g.ReloadAndWatch(id, &add, key); err != nil {
+		t.Fatalf("failed to reload add: %v", err)
+	}
+	err := g.UpdateItem(PluginItem{ID: id, File: "_example/test/plugins/plugin2/plugin2.so", Name: "Add", Version: "1.0",
+		Canary: &CanaryConfig{File: "_example/test/plugins/plugin1/plugin1.so", Version: "1.1", Percent: 50, Shadow: true}})
+	if err != nil {
+		t.Fatalf("failed to update add: %v", err)
+	}
+
+	// a call with the same key runs in the shadow every time or never.
+	shadowed := 0
+	for i := 1; i <= 100; i++ {
+		calls := m.Counter("glean_shadow_calls_total", "id", id, "version", "1.1")
+		add(i, 0)
+		first := m.Counter("glean_shadow_calls_total", "id", id, "version", "1.1") - calls
+		add(i, 0)
+		if second := m.Counter("glean_shadow_calls_total", "id", id, "version", "1.1") - calls - first; second != first {
+			t.Fatalf("expect add(%d, 0) to be sampled the same way but got %v and %v", i, first, second)
+		}
+		shadowed += int(first)
+	}
+	if shadowed == 0 || shadowed == 100 {
+		t.Errorf("expect some calls to run in the shadow at 50%% but got %d", shadowed)
+	}
+}
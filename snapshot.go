@@ -0,0 +1,95 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"plugin"
+	"sort"
+)
+
+// Snapshot is an immutable view of all symbols at one generation.
+// A request can pin a Snapshot for its whole lifetime and won't see half of a reload pass.
+type Snapshot struct {
+	generation uint64
+	items      map[string]snapshotItem
+}
+
+type snapshotItem struct {
+	item PluginItem
+	sym  plugin.Symbol
+}
+
+// Generation returns the generation of the snapshot.
+func (s *Snapshot) Generation() uint64 {
+	return s.generation
+}
+
+// IDs returns the sorted IDs of all items in the snapshot.
+func (s *Snapshot) IDs() []string {
+	ids := make([]string, 0, len(s.items))
+	for id := range s.items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Item returns the item by ID.
+func (s *Snapshot) Item(id string) (PluginItem, bool) {
+	si, ok := s.items[id]
+	return si.item, ok
+}
+
+// Lookup returns the symbol by ID. Like plugin.Lookup, a function is returned as a function value
+// and a variable is returned as a pointer.
+func (s *Snapshot) Lookup(id string) (interface{}, error) {
+	si, ok := s.items[id]
+	if !ok {
+		return nil, ErrItemHasNotConfigured
+	}
+	return si.sym, nil
+}
+
+// Load assigns the symbol by ID to the function or variable vPtr points to.
+func (s *Snapshot) Load(id string, vPtr interface{}) error {
+	si, ok := s.items[id]
+	if !ok {
+		return ErrItemHasNotConfigured
+	}
+	return assignSymbol(si.sym, vPtr)
+}
+
+// Snapshot returns the snapshot of the current generation.
+func (g *Glean) Snapshot() *Snapshot {
+	return g.snapshot.Load().(*Snapshot)
+}
+
+// Generation returns the current generation. It is bumped by every reload pass that changes items.
+func (g *Glean) Generation() uint64 {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.generation
+}
+
+// takeSnapshotLocked stores a new snapshot of active items. g.mu must be held.
+func (g *Glean) takeSnapshotLocked() {
+	s := &Snapshot{
+		generation: g.generation,
+		items:      make(map[string]snapshotItem, len(g.pluginItems)),
+	}
+
+	for _, item := range g.pluginItems {
+		if item.Cached == nil {
+			continue
+		}
+		sym, err := item.Cached.Lookup(item.Name)
+		if err != nil {
+			continue
+		}
+		s.items[item.ID] = snapshotItem{item: *item, sym: sym}
+	}
+
+	g.snapshot.Store(s)
+}
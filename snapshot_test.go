@@ -0,0 +1,56 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"testing"
+
+	"github.com/smallnest/glean/log"
+)
+
+func TestGlean_Snapshot(t *testing.T) {
+	log.SetDummyLogger()
+
+	g := New("plugin_test.json")
+	defer g.Close()
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	s1 := g.Snapshot()
+	if s1.Generation() != g.Generation() || s1.Generation() == 0 {
+		t.Fatalf("unexpected generation %d of snapshot, glean is %d", s1.Generation(), g.Generation())
+	}
+	if ids := s1.IDs(); len(ids) != 2 {
+		t.Fatalf("expect 2 items but got %v", ids)
+	}
+
+	err := g.UpdateItem(PluginItem{ID: "EF5A35EC-46EB-4E62-8251-78F1A49FA7DC", File: "_example/test/plugins/plugin1/plugin1.so", Name: "Add", Version: "1.1"})
+	if err != nil {
+		t.Fatalf("failed to update item: %v", err)
+	}
+	s2 := g.Snapshot()
+	if s2.Generation() != s1.Generation()+1 {
+		t.Errorf("expect generation %d but got %d", s1.Generation()+1, s2.Generation())
+	}
+
+	var fn1, fn2 func(x, y int) int
+	if err = s1.Load("EF5A35EC-46EB-4E62-8251-78F1A49FA7DC", &fn1); err != nil {
+		t.Fatalf("failed to load from s1: %v", err)
+	}
+	if err = s2.Load("EF5A35EC-46EB-4E62-8251-78F1A49FA7DC", &fn2); err != nil {
+		t.Fatalf("failed to load from s2: %v", err)
+	}
+	if fn1(1, 2) != 30 || fn2(1, 2) != 3 {
+		t.Errorf("s1 must keep plugin2 and s2 must use plugin1, got %d and %d", fn1(1, 2), fn2(1, 2))
+	}
+
+	if item, _ := s1.Item("EF5A35EC-46EB-4E62-8251-78F1A49FA7DC"); item.Version != "1.0" {
+		t.Errorf("expect version 1.0 in s1 but got %s", item.Version)
+	}
+	if _, err = s2.Lookup("nonExisted"); err != ErrItemHasNotConfigured {
+		t.Errorf("expect ErrItemHasNotConfigured but got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/smallnest/glean/log"
+)
+
+// lastKnownGoodFile is the name of the last known good config in the state directory.
+const lastKnownGoodFile = "last-known-good.json"
+
+// WithLastKnownGood makes Glean save the resolved config to dir every time all items are loaded without errors.
+// If the config can't be read or some of its items fail when LoadConfig is called, for example after a restart,
+// Glean falls back to the saved config and keeps watching the config file for a fix.
+// If copyPlugins is true, plugin files are copied to dir too, so the fallback doesn't depend on them.
+func WithLastKnownGood(dir string, copyPlugins bool) Option {
+	return func(g *Glean) {
+		g.stateDir = dir
+		g.copyPlugins = copyPlugins
+	}
+}
+
+// saveLastKnownGoodLocked saves active and skipped items to the state directory. g.mu must be held.
+func (g *Glean) saveLastKnownGoodLocked() {
+	if g.stateDir == "" {
+		return
+	}
+
+	items := make([]*PluginItem, 0, len(g.pluginItems)+len(g.skipped))
+	for _, item := range g.pluginItems {
+		cp := *item
+		items = append(items, &cp)
+	}
+
+	var err error
+	if g.copyPlugins {
+		err = copyPlugins(filepath.Join(g.stateDir, "plugins"), items)
+	}
+	items = append(items, g.skipped...)
+
+	if err == nil {
+		err = os.MkdirAll(g.stateDir, 0755)
+	}
+	var buf []byte
+	if err == nil {
+		buf, err = json.MarshalIndent(items, "", "    ")
+	}
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(g.stateDir, lastKnownGoodFile), buf)
+	}
+	if err != nil {
+		log.Errorf("failed to save the last known good config to %s: %v", g.stateDir, err)
+	}
+}
+
+// copyPlugins copies plugin files of items to dir, names them by their hashes and points items to the copies.
+// Copies that are no longer used are removed.
+func copyPlugins(dir string, items []*PluginItem) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	used := make(map[string]bool)
+	for _, item := range items {
+		if item.Hash == "" {
+			continue
+		}
+		dst := filepath.Join(dir, item.Hash+filepath.Ext(item.File))
+		if !used[dst] {
+			if _, err := os.Stat(dst); err != nil {
+				if err = copyFile(item.File, dst); err != nil {
+					return err
+				}
+				// the file may have been replaced since it was opened.
+				if h, _ := hashFile(dst); h != item.Hash {
+					os.Remove(dst)
+					log.Warnf("%s has changed since it was loaded, the last known good config refers to it", item.File)
+					continue
+				}
+			}
+			used[dst] = true
+		}
+		item.File = dst
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if file := filepath.Join(dir, fi.Name()); !used[file] {
+			os.Remove(file)
+		}
+	}
+	return nil
+}
+
+// fallbackLocked applies the last known good config because the current config is unusable for cause.
+// It returns cause if there is no last known good config. g.mu must be held.
+func (g *Glean) fallbackLocked(cause error) ([]Event, error) {
+	file := filepath.Join(g.stateDir, lastKnownGoodFile)
+	buf, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, cause
+	}
+	var items []*PluginItem
+	if err == nil {
+		err = json.Unmarshal(buf, &items)
+	}
+	if err != nil {
+		log.Errorf("failed to read the last known good config %s: %v", file, err)
+		return nil, multierror.Append(cause, err)
+	}
+
+	log.Errorf("THE CONFIG IS UNUSABLE, FALL BACK TO THE LAST KNOWN GOOD CONFIG %s: %v", file, cause)
+	events, err := g.applyLocked(items)
+	if err != nil {
+		return events, multierror.Append(cause, err)
+	}
+	g.fallback = true
+	return events, nil
+}
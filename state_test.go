@@ -0,0 +1,100 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/smallnest/glean/log"
+)
+
+func TestGlean_LastKnownGood(t *testing.T) {
+	log.SetDummyLogger()
+
+	file := copyConfig(t, "plugin_test.json")
+	defer os.RemoveAll(filepath.Dir(file))
+	good, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	stateDir := filepath.Join(filepath.Dir(file), "state")
+
+	g := New(file, WithLastKnownGood(stateDir, true))
+	if err = g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	g.Close()
+
+	if _, err = os.Stat(filepath.Join(stateDir, lastKnownGoodFile)); err != nil {
+		t.Fatalf("the last known good config is not saved: %v", err)
+	}
+	copies, _ := filepath.Glob(filepath.Join(stateDir, "plugins", "*.so"))
+	if len(copies) != 1 {
+		t.Errorf("expect a copy of plugin2.so but got %v", copies)
+	}
+
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{
+			name:   "broken",
+			config: `[{`,
+		},
+		{
+			name:   "missing plugin",
+			config: `[{"id":"EF5A35EC-46EB-4E62-8251-78F1A49FA7DC","file":"_example/test/plugins/pluginabc/plugin1.so","name":"Add"}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(file, []byte(tt.config), 0644); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+
+			g := New(file, WithLastKnownGood(stateDir, true))
+			defer g.Close()
+			if err := g.LoadConfig(); err != nil {
+				t.Fatalf("expect to fall back but got %v", err)
+			}
+
+			var fn func(x, y int) int
+			if err := g.Reload("EF5A35EC-46EB-4E62-8251-78F1A49FA7DC", &fn); err != nil {
+				t.Fatalf("failed to reload fn: %v", err)
+			}
+			if got := fn(1, 2); got != 30 {
+				t.Errorf("expect plugin2 Add to return 30 but got %d", got)
+			}
+			if d := g.DumpConfig(); !d.LastKnownGood || len(d.Items) != 2 {
+				t.Errorf("unexpected dump: %+v", d)
+			}
+
+			// a fixed config replaces the last known good config.
+			if err := ioutil.WriteFile(file, good, 0644); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+			if err := g.checkChanges(); err != nil {
+				t.Fatalf("failed to apply the fixed config: %v", err)
+			}
+			if d := g.DumpConfig(); d.LastKnownGood {
+				t.Errorf("expect the fixed config to be used")
+			}
+		})
+	}
+
+	// without the state directory LoadConfig fails.
+	if err = ioutil.WriteFile(file, []byte(`[{`), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	g = New(file)
+	defer g.Close()
+	if err = g.LoadConfig(); err == nil {
+		t.Errorf("expect an error for a broken config")
+	}
+}
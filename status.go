@@ -0,0 +1,138 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import "sort"
+
+// failure is the latest error of an item that failed to be swapped in.
+type failure struct {
+	item *PluginItem
+	err  error
+}
+
+// ItemStatus is the status of a configured item.
+type ItemStatus struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	File    string `json:"file"`
+	Version string `json:"version"`
+	Hash    string `json:"hash,omitempty"`
+	// Canary is the canary of the active version.
+	Canary *CanaryConfig `json:"canary,omitempty"`
+	// Generation is when the active version is swapped in.
+	Generation uint64 `json:"generation"`
+	// Active reports whether a version of the item is loaded.
+	Active bool `json:"active"`
+	// Watched reports whether a function or variable is bound to the item.
+	Watched bool `json:"watched"`
+	// Constraint is the version constraint of the bound function or variable.
+	Constraint string `json:"constraint,omitempty"`
+	// Error is the latest error of the item. If Active is true the shown version is still serving.
+	Error string `json:"error,omitempty"`
+	// Skipped is why the item doesn't apply to this process, such as "disabled".
+	Skipped string `json:"skipped,omitempty"`
+	// Quarantined is the version of the item that is quarantined, if there is one.
+	Quarantined string `json:"quarantined,omitempty"`
+}
+
+// Status returns the status of active items followed by items that failed to load and items that are skipped.
+func (g *Glean) Status() []ItemStatus {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var status []ItemStatus
+	for _, item := range g.pluginItems {
+		st := ItemStatus{
+			ID:         item.ID,
+			Name:       item.Name,
+			File:       item.File,
+			Version:    item.Version,
+			Hash:       item.Hash,
+			Canary:     item.Canary,
+			Generation: item.Generation,
+			Active:     true,
+			Watched:    g.watched[item.ID],
+			Constraint: g.constraintLocked(item.ID),
+		}
+		if q := g.quarantined[item.ID]; q != nil {
+			st.Quarantined = q.Version
+		}
+		if f := g.failures[item.ID]; f != nil {
+			st.Error = f.err.Error()
+		}
+		status = append(status, st)
+	}
+
+	var failed []string
+	for id := range g.failures {
+		if _, ok := g.idMap[id]; !ok {
+			failed = append(failed, id)
+		}
+	}
+	sort.Strings(failed)
+
+	for _, id := range failed {
+		f := g.failures[id]
+		st := ItemStatus{
+			ID:         id,
+			Name:       f.item.Name,
+			File:       f.item.File,
+			Version:    f.item.Version,
+			Hash:       f.item.Hash,
+			Watched:    g.watched[id],
+			Constraint: g.constraintLocked(id),
+			Error:      f.err.Error(),
+		}
+		if q := g.quarantined[id]; q != nil {
+			st.Quarantined = q.Version
+		}
+		status = append(status, st)
+	}
+
+	for _, item := range g.skipped {
+		if _, ok := g.idMap[item.ID]; ok || g.failures[item.ID] != nil {
+			continue // another variant of the item applies, such as one for a different goarch.
+		}
+		status = append(status, ItemStatus{
+			ID:      item.ID,
+			Name:    item.Name,
+			File:    item.File,
+			Version: item.Version,
+			Watched: g.watched[item.ID],
+			Skipped: g.skipReason(item),
+		})
+	}
+
+	return status
+}
+
+func (g *Glean) constraintLocked(id string) string {
+	if b := g.bindings[id]; b != nil && b.constraint != nil {
+		return b.constraint.String()
+	}
+	return ""
+}
+
+// pruneFailuresLocked forgets failures of items that are no longer configured,
+// or that are configured as their active versions again. g.mu must be held.
+func (g *Glean) pruneFailuresLocked(latestPluginItems []*PluginItem, cs *ChangeSet) {
+	if len(g.failures) == 0 {
+		return
+	}
+
+	configured := make(map[string]bool, len(latestPluginItems))
+	for _, item := range latestPluginItems {
+		configured[item.ID] = true
+	}
+	changed := make(map[string]bool, len(cs.Changed))
+	for _, c := range cs.Changed {
+		changed[c.New.ID] = true
+	}
+	for id := range g.failures {
+		if _, active := g.idMap[id]; !configured[id] || active && !changed[id] {
+			delete(g.failures, id)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"context"
+	"plugin"
+	"reflect"
+	"runtime/pprof"
+	"time"
+
+	"github.com/smallnest/glean/metrics"
+)
+
+// Instrument wraps the bound function to record calls, latencies and panics per item ID and version:
+//
+//	glean_calls_total{id, version}
+//	glean_call_seconds{id, version}
+//	glean_call_panics_total{id, version}
+//
+// Panics are recorded and passed on. Variables are not wrapped.
+// Functions that are bound without it are assigned as they are, so they have no overhead.
+func Instrument() BindOption {
+	return func(b *binding) error {
+		b.instrument = true
+		return nil
+	}
+}
+
+// PprofLabels runs calls of the bound function under runtime/pprof labels glean_id, glean_version and glean_file,
+// so CPU profiles can be sliced by plugin and version. If the first parameter of the function is a context.Context,
+// the labels are added to it and the labeled context is passed to the function.
+func PprofLabels() BindOption {
+	return func(b *binding) error {
+		b.pprofLabels = true
+		return nil
+	}
+}
+
+// wrap binds s of item to b and returns the symbol that is assigned to the bound function or variable.
+// Functions are wrapped by the options of b that intercept calls, and routed to the canary of item if it has one.
+func (g *Glean) wrap(b *binding, item *PluginItem, s plugin.Symbol) plugin.Symbol {
+	if b == nil {
+		return s
+	}
+	b.bind(item, s)
+	canary := item.Canary != nil && item.Canary.Cached != nil
+	if !(b.instrument || b.pprofLabels || b.recover || b.breaker != nil || canary) {
+		return s
+	}
+	fn := reflect.ValueOf(s)
+	if fn.Kind() != reflect.Func {
+		return s
+	}
+
+	fn = g.wrapFunc(b, item, fn)
+	if canary {
+		fn = g.canaryFunc(b, item, fn)
+	}
+	return fn.Interface()
+}
+
+// wrapFunc wraps fn of item by the options of b that intercept calls.
+func (g *Glean) wrapFunc(b *binding, item *PluginItem, fn reflect.Value) reflect.Value {
+	if b.pprofLabels {
+		fn = labelFunc(item, fn)
+	}
+	if b.instrument {
+		fn = instrumentFunc(item, fn)
+	}
+	if b.breaker != nil {
+		fn = g.breakerFunc(b.breaker, item, fn)
+	}
+	if b.recover {
+		fn = g.recoverFunc(b, item, fn)
+	}
+	return fn
+}
+
+// callFunc calls fn with in, which is the arguments of a function made by reflect.MakeFunc.
+func callFunc(fn reflect.Value, in []reflect.Value) []reflect.Value {
+	if fn.Type().IsVariadic() {
+		return fn.CallSlice(in)
+	}
+	return fn.Call(in)
+}
+
+// instrumentFunc wraps fn to record calls, latencies and panics.
+func instrumentFunc(item *PluginItem, fn reflect.Value) reflect.Value {
+	labels := []string{"id", item.ID, "version", item.Version}
+	return reflect.MakeFunc(fn.Type(), func(in []reflect.Value) []reflect.Value {
+		metrics.Add("glean_calls_total", 1, labels...)
+		start := time.Now()
+		defer func() {
+			metrics.Observe("glean_call_seconds", time.Since(start).Seconds(), labels...)
+			if r := recover(); r != nil {
+				metrics.Add("glean_call_panics_total", 1, labels...)
+				panic(r)
+			}
+		}()
+		return callFunc(fn, in)
+	})
+}
+
+// labelFunc wraps fn to run under pprof labels of item.
+func labelFunc(item *PluginItem, fn reflect.Value) reflect.Value {
+	labels := pprof.Labels("glean_id", item.ID, "glean_version", item.Version, "glean_file", item.File)
+	t := fn.Type()
+	withCtx := t.NumIn() > 0 && t.In(0) == contextType
+
+	return reflect.MakeFunc(t, func(in []reflect.Value) (out []reflect.Value) {
+		ctx := context.Background()
+		if withCtx && !in[0].IsNil() {
+			ctx = in[0].Interface().(context.Context)
+		}
+		pprof.Do(ctx, labels, func(ctx context.Context) {
+			if withCtx {
+				in[0] = reflect.ValueOf(&ctx).Elem()
+			}
+			out = callFunc(fn, in)
+		})
+		return out
+	})
+}
@@ -0,0 +1,158 @@
+// Copyright 2009 smallnest. All rights reserved.
+// Use of this source code is governed by Apache License Version 2.0
+// license that can be found in the LICENSE file.
+
+package glean
+
+import (
+	"context"
+	"reflect"
+	"runtime/pprof"
+	"testing"
+
+	"github.com/smallnest/glean/log"
+	"github.com/smallnest/glean/metrics"
+)
+
+func newWrapTestGlean(t testing.TB) *Glean {
+	g := New("plugin_test.json")
+	if err := g.LoadConfig(); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	err := g.AddItem(PluginItem{ID: "div", File: "_example/test/plugins/plugin1/plugin1.so", Name: "Div", Version: "1.0"})
+	if err != nil {
+		t.Fatalf("failed to add div: %v", err)
+	}
+	return g
+}
+
+func TestGlean_Instrument(t *testing.T) {
+	log.SetDummyLogger()
+	m := metrics.NewExpvarMetrics("")
+	metrics.SetMetrics(m)
+	defer metrics.SetDummyMetrics()
+
+	g := newWrapTestGlean(t)
+	defer g.Close()
+
+	var div func(x, y int) int
+	if err := g.ReloadAndWatch("div", &div, Instrument()); err != nil {
+		t.Fatalf("failed to reload div: %v", err)
+	}
+
+	if got := div(6, 3); got != 2 {
+		t.Errorf("div(6, 3) = %d, want 2", got)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("expect div(1, 0) to panic")
+			}
+		}()
+		div(1, 0)
+	}()
+
+	err := g.UpdateItem(PluginItem{ID: "div", File: "_example/test/plugins/plugin1/plugin1.so", Name: "Div", Version: "1.1"})
+	if err != nil {
+		t.Fatalf("failed to update div: %v", err)
+	}
+	div(6, 3)
+
+	tests := []struct {
+		name    string
+		version string
+		want    float64
+	}{
+		{name: "glean_calls_total", version: "1.0", want: 2},
+		{name: "glean_call_panics_total", version: "1.0", want: 1},
+		{name: "glean_calls_total", version: "1.1", want: 1},
+		{name: "glean_call_panics_total", version: "1.1", want: 0},
+	}
+	for _, tt := range tests {
+		if got := m.Counter(tt.name, "id", "div", "version", tt.version); got != tt.want {
+			t.Errorf("%s of %s = %v, want %v", tt.name, tt.version, got, tt.want)
+		}
+	}
+	if got := m.HistogramCount("glean_call_seconds", "id", "div", "version", "1.0"); got != 2 {
+		t.Errorf("glean_call_seconds count = %d, want 2", got)
+	}
+
+	// variables are not wrapped.
+	var v int
+	if err = g.Reload("2E8FD057-99EC-41B9-8172-0EBF18F9A48D", &v, Instrument()); err != nil || v != 100 {
+		t.Errorf("failed to reload v: %v", err)
+	}
+}
+
+func TestPprofLabels(t *testing.T) {
+	b, err := newBinding([]BindOption{PprofLabels(), Instrument()})
+	if err != nil {
+		t.Fatalf("failed to create binding: %v", err)
+	}
+	item := &PluginItem{ID: "a", File: "a.so", Version: "1.0"}
+
+	var labels []string
+	get := func(ctx context.Context, key string) string {
+		v, _ := pprof.Label(ctx, key)
+		return v
+	}
+	var fn func(ctx context.Context, keys ...string) int
+	err = assignSymbol(New("").wrap(b, item, func(ctx context.Context, keys ...string) int {
+		for _, k := range keys {
+			labels = append(labels, get(ctx, k))
+		}
+		return len(keys)
+	}), &fn)
+	if err != nil {
+		t.Fatalf("failed to assign fn: %v", err)
+	}
+
+	ctx := pprof.WithLabels(context.Background(), pprof.Labels("request", "r1"))
+	if n := fn(ctx, "glean_id", "glean_version", "glean_file", "request"); n != 4 {
+		t.Errorf("fn() = %d, want 4", n)
+	}
+	if want := []string{"a", "1.0", "a.so", "r1"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("labels = %v, want %v", labels, want)
+	}
+}
+
+// BenchmarkCall compares calling a plugin function directly, wrapped by Instrument or PprofLabels,
+// and through a pointer to the bound function as handlers usually do.
+func BenchmarkCall(b *testing.B) {
+	log.SetDummyLogger()
+	g := newWrapTestGlean(b)
+	defer g.Close()
+
+	var direct, wrapped, labeled func(x, y int) int
+	if err := g.Reload("div", &direct); err != nil {
+		b.Fatalf("failed to reload div: %v", err)
+	}
+	if err := g.Reload("div", &wrapped, Instrument()); err != nil {
+		b.Fatalf("failed to reload div: %v", err)
+	}
+	if err := g.Reload("div", &labeled, PprofLabels()); err != nil {
+		b.Fatalf("failed to reload div: %v", err)
+	}
+	ptr := &direct
+
+	b.Run("direct", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			direct(i, 3)
+		}
+	})
+	b.Run("wrapped", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			wrapped(i, 3)
+		}
+	})
+	b.Run("labeled", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			labeled(i, 3)
+		}
+	})
+	b.Run("pointer", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			(*ptr)(i, 3)
+		}
+	})
+}